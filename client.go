@@ -0,0 +1,508 @@
+package remotehttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Client returns a http.Client which uses our transport, and the options
+// set via SetDefaultOptions, if any.
+//
+// See NewClient for details.
+func Client() *http.Client {
+
+	opts := getDefaultOptions()
+	c, err := NewClient(opts)
+
+	// Without the environment the options are those which
+	// SetDefaultOptions validated.
+	if opts, retry := _withoutEnvAllowlist(opts, err); retry {
+		c, _ = NewClient(opts)
+	}
+	return c
+}
+
+// NewClient returns a http.Client which uses a SafeTransport configured
+// with the given options.
+//
+// The client's timeout is set from ClientTimeout, and redirects are
+// validated via the transport's CheckRedirect function.  The client also
+// applies the options which affect requests and responses as a whole,
+// such as MaxTotalBytes, which are not applied by the transport.
+func NewClient(opts Options) (*http.Client, error) {
+
+	if opts.ClientTimeout < 0 {
+		return nil, fmt.Errorf("client timeout must not be negative")
+	}
+	if opts.MaxTotalBytes < 0 || opts.TotalBytesWindow < 0 || opts.MaxResponseBytes < 0 {
+		return nil, fmt.Errorf("byte limits must not be negative")
+	}
+	if opts.RequestsPerSecond < 0 || opts.Burst < 0 {
+		return nil, fmt.Errorf("rate limits must not be negative")
+	}
+
+	t, err := NewTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &clientTransport{
+		transport: t,
+		options:   opts,
+	}
+	if opts.MaxTotalBytes > 0 {
+		c.budget = &byteBudget{
+			max:    opts.MaxTotalBytes,
+			window: opts.TotalBytesWindow,
+			start:  clock(),
+		}
+	}
+	if opts.RequestsPerSecond > 0 {
+		burst := opts.Burst
+		if burst == 0 {
+			burst = 1
+		}
+		c.limits = &hostLimits{
+			rate:     rate.Limit(opts.RequestsPerSecond),
+			burst:    burst,
+			size:     maxHostLimiters,
+			limiters: make(map[string]*hostLimiter),
+		}
+	}
+
+	return &http.Client{
+		Transport:     c,
+		CheckRedirect: t.CheckRedirect,
+		Timeout:       opts.ClientTimeout,
+	}, nil
+}
+
+// WrapClient adds our protection to an existing http.Client, using the
+// options set via SetDefaultOptions.
+//
+// See SafeTransport.WrapClient for details.
+func WrapClient(c *http.Client) error {
+	return getDefaultTransport().WrapClient(c)
+}
+
+// WrapClient adds our protection to an existing http.Client, by replacing
+// the DialContext function of its transport, such that connections are
+// made via this transport.
+//
+// The client's transport must be a *http.Transport, and it is modified
+// in place; any idle connections it holds are closed, so that all later
+// requests use connections we've checked.  If the client has no transport
+// then a clone of http.DefaultTransport is used, without its proxy.
+//
+// An error is returned if the transport can't be wrapped safely, for
+// example if it uses a custom DialTLSContext function, or a proxy, as
+// those connections wouldn't be made via our DialContext.  A client which
+// already uses this transport is left unchanged, but one which uses a
+// different SafeTransport is rejected, as its options would differ.
+//
+// Only connections are checked; options which are applied by RoundTrip,
+// such as AllowUserInfo, or by NewClient, are not.
+func (t *SafeTransport) WrapClient(c *http.Client) error {
+
+	if c.Transport == nil {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.Proxy = nil
+		c.Transport = tr
+	}
+
+	var tr *http.Transport
+	switch v := c.Transport.(type) {
+	case *SafeTransport:
+		if v != t {
+			return fmt.Errorf("client already uses a different SafeTransport")
+		}
+		return nil
+	case *http.Transport:
+		tr = v
+	default:
+		return fmt.Errorf("cannot wrap a client with transport %T", c.Transport)
+	}
+
+	if tr.DialTLSContext != nil || tr.DialTLS != nil {
+		return fmt.Errorf("cannot wrap a transport with a custom TLS dialler")
+	}
+	if tr.Proxy != nil {
+		return fmt.Errorf("cannot wrap a transport which uses a proxy")
+	}
+
+	tr.Dial = nil
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (_checker(ctx, t, network, addr))
+	}
+
+	// Connections made before we were installed weren't checked.
+	tr.CloseIdleConnections()
+	return nil
+}
+
+// clientTransport is the http.RoundTripper used by clients created via
+// NewClient.
+//
+// It wraps a SafeTransport, applying the options which affect requests
+// and responses as a whole.
+type clientTransport struct {
+
+	// The transport we wrap.
+	transport *SafeTransport
+
+	// The options we were created with.
+	options Options
+
+	// The budget for the bytes we read, if any.
+	budget *byteBudget
+
+	// The rate limits for each host, if any.
+	limits *hostLimits
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (c *clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	// Is the method permitted?
+	if err := c.checkMethod(req); err != nil {
+		return nil, err
+	}
+
+	// Is our byte budget exhausted?
+	if c.budget != nil {
+		if err := c.budget.check(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Wait for our rate limit, if any.
+	if c.limits != nil {
+		// Hosts are normalized, as they are when matching our
+		// lists, so that each spelling of a host shares a limit.
+		host, err := _normalizeHost(req.URL.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		limiter := c.limits.get(host)
+		if c.options.RateLimitError {
+			if !limiter.Allow() {
+				return nil, fmt.Errorf("rate limit exceeded for %s", host)
+			}
+		} else if err := limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Identify ourselves, unless the caller already has.
+	if c.options.UserAgent != "" {
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req = req.Clone(req.Context())
+			req.Header.Set("User-Agent", c.options.UserAgent)
+		}
+	}
+
+	// Remove cookies from requests which are redirected to another
+	// host, without modifying the caller's request.
+	if c.options.StripCookiesOnCrossHostRedirect && _isCrossHostRedirect(req) {
+		req = req.Clone(req.Context())
+		req.Header.Del("Cookie")
+	}
+
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Is the content-type permitted?
+	err = c.checkContentType(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	// Limit the size of the body.
+	if max := c.options.MaxResponseBytes; max > 0 {
+		if resp.ContentLength > max {
+			resp.Body.Close()
+			return nil, fmt.Errorf("response from %s has length %d, which exceeds the limit of %d bytes", req.URL.Redacted(), resp.ContentLength, max)
+		}
+		resp.Body = &limitReader{ReadCloser: resp.Body, max: max, remaining: max}
+	}
+
+	// Count the bytes we read.
+	if c.budget != nil {
+		resp.Body = &budgetReader{ReadCloser: resp.Body, budget: c.budget}
+	}
+
+	return resp, nil
+}
+
+// checkContentType tests whether the given response has one of our
+// permitted content-types.
+func (c *clientTransport) checkContentType(resp *http.Response) error {
+
+	if len(c.options.AllowedContentTypes) == 0 {
+		return nil
+	}
+
+	// Redirects, and responses without bodies, needn't be tested.
+	if (resp.StatusCode >= 300 && resp.StatusCode < 400) || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	header := resp.Header.Get("Content-Type")
+	media, _, err := mime.ParseMediaType(header)
+	if err == nil {
+		for _, allowed := range c.options.AllowedContentTypes {
+			if _matchContentType(media, allowed) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("response from %s has content-type %q, which is denied", resp.Request.URL.Redacted(), header)
+}
+
+// checkMethod tests whether the given request uses a method we permit.
+func (c *clientTransport) checkMethod(req *http.Request) error {
+
+	if len(c.options.AllowedMethods) == 0 {
+		return nil
+	}
+
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	for _, allowed := range c.options.AllowedMethods {
+		if strings.EqualFold(method, allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("request to %s uses method %s, which is denied", req.URL.Redacted(), method)
+}
+
+// _matchContentType tests whether the given media type matches the given
+// pattern, which may have a wildcard subtype such as "image/*".
+func _matchContentType(media, pattern string) bool {
+
+	media = strings.ToLower(media)
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+	if pattern == "*/*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(media, strings.TrimSuffix(pattern, "*"))
+	}
+	return media == pattern
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped
+// transport, which allows http.Client.CloseIdleConnections to work.
+func (c *clientTransport) CloseIdleConnections() {
+	c.transport.CloseIdleConnections()
+}
+
+// _isCrossHostRedirect returns true if the given request is the result of
+// a redirect, to a host other than the one originally requested.
+func _isCrossHostRedirect(req *http.Request) bool {
+
+	// Find the original request.
+	orig := req
+	for orig.Response != nil && orig.Response.Request != nil {
+		orig = orig.Response.Request
+	}
+
+	return !strings.EqualFold(orig.URL.Hostname(), req.URL.Hostname())
+}
+
+// limitReader is an io.ReadCloser which fails once more than a given
+// number of bytes have been read from it.
+type limitReader struct {
+	io.ReadCloser
+
+	// The maximum number of bytes we may read.
+	max int64
+
+	// The number of bytes we may still read.
+	remaining int64
+}
+
+// Read reads from the wrapped reader, failing once our limit has been
+// exceeded.
+func (l *limitReader) Read(p []byte) (int, error) {
+
+	// Read one more byte than we permit, so that we can tell if the
+	// limit has been exceeded.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.ReadCloser.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		return n, fmt.Errorf("response body exceeds the limit of %d bytes", l.max)
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// maxHostLimiters is the maximum number of hosts for which we'll hold rate
+// limiters, to bound our memory use when fetching many distinct hosts.
+const maxHostLimiters = 1000
+
+// hostLimiter is the rate limiter of a single host.
+type hostLimiter struct {
+
+	// The limiter itself.
+	limiter *rate.Limiter
+
+	// The time at which the limiter was last used.
+	used time.Time
+}
+
+// hostLimits holds the rate limiters for each host.
+type hostLimits struct {
+
+	// The rate and burst of each limiter.
+	rate  rate.Limit
+	burst int
+
+	// The maximum number of limiters to store.
+	size int
+
+	// Lock for our limiters.
+	mutex sync.Mutex
+
+	// The limiters, keyed by (lower-cased) hostname.
+	limiters map[string]*hostLimiter
+}
+
+// get returns the limiter for the given (lower-cased) host, creating it
+// if necessary.
+//
+// If we hold too many limiters then those which have been idle for long
+// enough to refill are removed, as a new limiter would be identical, and
+// if that doesn't make room the least recently used is evicted.
+func (h *hostLimits) get(host string) *rate.Limiter {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := clock()
+
+	entry, ok := h.limiters[host]
+	if !ok {
+		if len(h.limiters) >= h.size {
+
+			// The time taken for a limiter to refill.
+			refill := time.Duration(float64(h.burst) / float64(h.rate) * float64(time.Second))
+
+			// Remove refilled limiters, finding the oldest
+			// as we go.
+			oldest := ""
+			for name, l := range h.limiters {
+				if now.Sub(l.used) >= refill {
+					delete(h.limiters, name)
+					continue
+				}
+				if oldest == "" || l.used.Before(h.limiters[oldest].used) {
+					oldest = name
+				}
+			}
+
+			// Still full?  Remove the oldest.
+			if len(h.limiters) >= h.size {
+				delete(h.limiters, oldest)
+			}
+		}
+
+		entry = &hostLimiter{limiter: rate.NewLimiter(h.rate, h.burst)}
+		h.limiters[host] = entry
+	}
+	entry.used = now
+	return entry.limiter
+}
+
+// byteBudget tracks the number of bytes read within a window.
+type byteBudget struct {
+
+	// Lock for our state.
+	mutex sync.Mutex
+
+	// The maximum number of bytes we may read.
+	max int64
+
+	// The period after which our count is reset, if any.
+	window time.Duration
+
+	// The start of the current window.
+	start time.Time
+
+	// The number of bytes read in the current window.
+	used int64
+}
+
+// reset resets our count, if the current window has expired.
+//
+// The caller must hold our lock.
+func (b *byteBudget) reset() {
+	if b.window > 0 && clock().Sub(b.start) >= b.window {
+		b.start = clock()
+		b.used = 0
+	}
+}
+
+// check returns an error if the budget has been exceeded.
+func (b *byteBudget) check() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.reset()
+	if b.used > b.max {
+		return fmt.Errorf("total byte budget of %d exceeded", b.max)
+	}
+	return nil
+}
+
+// add records that the given number of bytes were read, returning an
+// error if the budget has been exceeded.
+func (b *byteBudget) add(n int) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.reset()
+	b.used += int64(n)
+	if b.used > b.max {
+		return fmt.Errorf("total byte budget of %d exceeded", b.max)
+	}
+	return nil
+}
+
+// budgetReader is an io.ReadCloser which records the bytes read from it
+// against a budget.
+type budgetReader struct {
+	io.ReadCloser
+
+	// The budget we're recording against.
+	budget *byteBudget
+}
+
+// Read reads from the wrapped reader, failing once the budget has been
+// exceeded.
+func (b *budgetReader) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if berr := b.budget.add(n); berr != nil {
+		return n, berr
+	}
+	return n, err
+}
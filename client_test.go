@@ -0,0 +1,562 @@
+package remotehttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Test that the client timeout is set.
+func TestClientTimeout(t *testing.T) {
+
+	c := Client()
+	if c.Timeout != 30*time.Second {
+		t.Fatalf("unexpected default timeout %s", c.Timeout)
+	}
+
+	opts := DefaultOptions()
+	opts.ClientTimeout = 5 * time.Second
+	c, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %s", err.Error())
+	}
+	if c.Timeout != 5*time.Second {
+		t.Fatalf("unexpected timeout %s", c.Timeout)
+	}
+
+	// Zero disables the timeout.
+	c, err = NewClient(Options{})
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %s", err.Error())
+	}
+	if c.Timeout != 0 {
+		t.Fatalf("unexpected timeout %s", c.Timeout)
+	}
+
+	_, err = NewClient(Options{ClientTimeout: -1})
+	if err == nil {
+		t.Fatalf("expected error with a negative timeout")
+	}
+}
+
+// Test that the total bytes read may be capped.
+func TestMaxTotalBytes(t *testing.T) {
+
+	srv, port := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 100))
+	}))
+	defer srv.Close()
+
+	opts := DefaultOptions()
+	opts.AllowCIDRs = []string{"127.0.0.1/32"}
+	opts.MaxTotalBytes = 250
+	opts.TotalBytesWindow = time.Minute
+
+	f, restore := useFakeClock()
+	defer restore()
+
+	c, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %s", err.Error())
+	}
+
+	fetch := func() error {
+		resp, err := c.Get("http://127.0.0.1:" + port + "/")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		return err
+	}
+
+	// The first two requests are within our budget.
+	for i := 0; i < 2; i++ {
+		if err = fetch(); err != nil {
+			t.Fatalf("unexpected error with request %d: %s", i, err.Error())
+		}
+	}
+
+	// The third exceeds it, whilst reading.
+	err = fetch()
+	if err == nil || !strings.Contains(err.Error(), "budget of 250 exceeded") {
+		t.Fatalf("expected the budget to be exceeded, got %v", err)
+	}
+
+	// And further requests fail before they're made.
+	err = fetch()
+	if err == nil || !strings.Contains(err.Error(), "budget of 250 exceeded") {
+		t.Fatalf("expected the budget to be exceeded, got %v", err)
+	}
+
+	// Once the window expires we can fetch again.
+	f.Advance(time.Minute)
+	if err = fetch(); err != nil {
+		t.Fatalf("unexpected error after the window expired: %s", err.Error())
+	}
+}
+
+// Test that cookies may be stripped on cross-host redirects.
+func TestStripCookiesOnCrossHostRedirect(t *testing.T) {
+
+	mux := http.NewServeMux()
+	srv, port := testServer(t, mux)
+	defer srv.Close()
+
+	// Set a cookie for the whole domain, then redirect to a subdomain.
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret", Domain: "a.example", Path: "/"})
+		http.Redirect(w, r, "http://other.a.example:"+port+"/cookies", http.StatusFound)
+	})
+	mux.HandleFunc("/cookies", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Cookie")))
+	})
+
+	for _, strip := range []bool{true, false} {
+
+		opts := DefaultOptions()
+		opts.AllowCIDRs = []string{"127.0.0.1/32"}
+		opts.Resolver = newFakeResolver(map[string][]string{
+			"a.example":       {"127.0.0.1"},
+			"other.a.example": {"127.0.0.1"},
+		})
+		opts.StripCookiesOnCrossHostRedirect = strip
+
+		c, err := NewClient(opts)
+		if err != nil {
+			t.Fatalf("unexpected error creating client: %s", err.Error())
+		}
+		c.Jar, _ = cookiejar.New(nil)
+
+		resp, err := c.Get("http://a.example:" + port + "/login")
+		if err != nil {
+			t.Fatalf("unexpected error making request: %s", err.Error())
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		sent := strings.Contains(string(body), "session=secret")
+		if sent == strip {
+			t.Fatalf("unexpected cookies with strip=%t: %q", strip, body)
+		}
+
+		// Same-host requests still send their cookies.
+		resp, err = c.Get("http://other.a.example:" + port + "/cookies")
+		if err != nil {
+			t.Fatalf("unexpected error making request: %s", err.Error())
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if !strings.Contains(string(body), "session=secret") {
+			t.Fatalf("expected cookies to be sent to the same host: %q", body)
+		}
+	}
+}
+
+// Test that existing clients may be wrapped.
+func TestWrapClient(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	// A pre-configured client, which uses a private transport.
+	jar, _ := cookiejar.New(nil)
+	tr := &http.Transport{MaxIdleConns: 5}
+	c := &http.Client{Transport: tr, Jar: jar, Timeout: 5 * time.Second}
+
+	// Before wrapping it may fetch local resources.
+	resp, err := c.Get("http://127.0.0.1:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error before wrapping: %s", err.Error())
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// Wrapping closes the idle connection, which wasn't checked.
+	err = WrapClient(c)
+	if err != nil {
+		t.Fatalf("unexpected error wrapping client: %s", err.Error())
+	}
+
+	// Afterwards it may not.
+	_, err = c.Get("http://127.0.0.1:" + port + "/")
+	if err == nil || !strings.Contains(err.Error(), "denied as local") {
+		t.Fatalf("expected a local address to be denied, got %v", err)
+	}
+
+	// The client's settings are retained.
+	if c.Transport != tr || tr.MaxIdleConns != 5 || c.Jar != jar {
+		t.Fatalf("the client's settings were not retained")
+	}
+
+	// A client without a transport is given one, leaving the
+	// default transport alone.
+	c = &http.Client{}
+	if err = WrapClient(c); err != nil {
+		t.Fatalf("unexpected error wrapping client: %s", err.Error())
+	}
+	if c.Transport == http.DefaultTransport {
+		t.Fatalf("the default transport was wrapped")
+	}
+	_, err = c.Get("http://127.0.0.1:" + port + "/")
+	if err == nil || !strings.Contains(err.Error(), "denied as local") {
+		t.Fatalf("expected a local address to be denied, got %v", err)
+	}
+
+	// A client using our transport is unchanged, but one using
+	// another SafeTransport is rejected.
+	st, err := NewTransport(DefaultOptions())
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	if err = st.WrapClient(&http.Client{Transport: st}); err != nil {
+		t.Fatalf("unexpected error wrapping client: %s", err.Error())
+	}
+	if err = WrapClient(&http.Client{Transport: st}); err == nil {
+		t.Fatalf("expected error wrapping a client with a different SafeTransport")
+	}
+
+	// Clients we can't wrap safely are rejected.
+	tests := []*http.Client{
+		{Transport: http.NewFileTransport(http.Dir("."))},
+		{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}},
+		{Transport: &http.Transport{DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, nil
+		}}},
+	}
+	for _, test := range tests {
+		if err = WrapClient(test); err == nil {
+			t.Fatalf("expected error wrapping %T", test.Transport)
+		}
+	}
+}
+
+// Test that response content-types may be restricted.
+func TestAllowedContentTypes(t *testing.T) {
+
+	srv, port := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("type") != "" {
+			w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		}
+		w.Write([]byte("OK"))
+	}))
+	defer srv.Close()
+
+	opts := DefaultOptions()
+	opts.AllowCIDRs = []string{"127.0.0.1/32"}
+	opts.AllowedContentTypes = []string{"text/html", "Image/*", "application/pdf"}
+
+	c, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %s", err.Error())
+	}
+
+	tests := map[string]bool{
+		"text/html":                true,
+		"TEXT/HTML; charset=utf-8": true,
+		"image/png":                true,
+		"image/svg+xml":            true,
+		"application/pdf":          true,
+		"text/plain":               false,
+		"application/x-imagemagic": false,
+		"imagefoo/png":             false,
+		"invalid;;":                false,
+	}
+
+	for ct, ok := range tests {
+		resp, err := c.Get("http://127.0.0.1:" + port + "/?type=" + url.QueryEscape(ct))
+		if ok {
+			if err != nil {
+				t.Fatalf("unexpected error with content-type %s: %s", ct, err.Error())
+			}
+			resp.Body.Close()
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "which is denied") {
+			t.Fatalf("expected content-type %s to be denied, got %v", ct, err)
+		}
+	}
+
+	// A wildcard permits everything.
+	if !_matchContentType("application/octet-stream", "*/*") {
+		t.Fatalf("expected */* to match everything")
+	}
+}
+
+// Test that requests may be rate-limited per host.
+func TestRequestsPerSecond(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	for _, fail := range []bool{true, false} {
+
+		opts := DefaultOptions()
+		opts.AllowCIDRs = []string{"127.0.0.1/32"}
+		opts.Resolver = newFakeResolver(map[string][]string{
+			"one.example": {"127.0.0.1"},
+			"two.example": {"127.0.0.1"},
+		})
+		opts.RequestsPerSecond = 10
+		opts.RateLimitError = fail
+
+		c, err := NewClient(opts)
+		if err != nil {
+			t.Fatalf("unexpected error creating client: %s", err.Error())
+		}
+
+		fetch := func(host string) error {
+			resp, err := c.Get("http://" + host + ":" + port + "/")
+			if err != nil {
+				return err
+			}
+			io.ReadAll(resp.Body)
+			return resp.Body.Close()
+		}
+
+		start := time.Now()
+
+		// The first request to each host is made immediately.
+		for _, host := range []string{"one.example", "two.example"} {
+			if err = fetch(host); err != nil {
+				t.Fatalf("unexpected error fetching %s: %s", host, err.Error())
+			}
+		}
+
+		// Further requests exceed the limit.
+		err = fetch("ONE.example")
+		if fail {
+			if err == nil || !strings.Contains(err.Error(), "rate limit exceeded for one.example") {
+				t.Fatalf("expected the rate limit to be exceeded, got %v", err)
+			}
+
+			// Including for other spellings of the host.
+			err = fetch("one.example.")
+			if err == nil || !strings.Contains(err.Error(), "rate limit exceeded for one.example") {
+				t.Fatalf("expected the rate limit to be exceeded with a trailing period, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if err = fetch("one.example"); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+
+		// So we waited for them.
+		if time.Since(start) < 150*time.Millisecond {
+			t.Fatalf("expected requests to be throttled, took %s", time.Since(start))
+		}
+
+		// Unless our context is cancelled.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://one.example:"+port+"/", nil)
+		if _, err = c.Do(req); err == nil {
+			t.Fatalf("expected error with a cancelled context")
+		}
+	}
+
+	_, err := NewClient(Options{RequestsPerSecond: -1})
+	if err == nil {
+		t.Fatalf("expected error with a negative rate")
+	}
+}
+
+// Test that the number of hosts we hold rate limiters for is bounded.
+func TestHostLimitsBounded(t *testing.T) {
+
+	f, restore := useFakeClock()
+	defer restore()
+
+	h := &hostLimits{rate: rate.Limit(1), burst: 2, size: 3, limiters: make(map[string]*hostLimiter)}
+
+	// Our first host remains in use, so is never evicted.
+	first := h.get("first.example")
+	for i := 0; i < 100; i++ {
+		h.get(fmt.Sprintf("host%d.example", i))
+		f.Advance(time.Millisecond)
+		if h.get("first.example") != first {
+			t.Fatalf("a recently used limiter was evicted")
+		}
+		if len(h.limiters) > 3 {
+			t.Fatalf("expected at most three limiters, got %d", len(h.limiters))
+		}
+	}
+
+	// Once they've refilled idle limiters are removed together.
+	f.Advance(2 * time.Second)
+	h.get("last.example")
+	if len(h.limiters) != 1 {
+		t.Fatalf("expected idle limiters to be removed, got %d", len(h.limiters))
+	}
+}
+
+// Test that a User-Agent may be set on each request.
+func TestUserAgent(t *testing.T) {
+
+	srv, port := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.UserAgent()))
+	}))
+	defer srv.Close()
+
+	opts := DefaultOptions()
+	opts.AllowCIDRs = []string{"127.0.0.1/32"}
+	opts.UserAgent = "fetcher/1.0"
+
+	c, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %s", err.Error())
+	}
+
+	fetch := func(agent *string) string {
+		req, err := http.NewRequest("GET", "http://127.0.0.1:"+port+"/", nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %s", err.Error())
+		}
+		if agent != nil {
+			req.Header.Set("User-Agent", *agent)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		// The caller's request isn't modified.
+		if agent == nil && req.Header.Get("User-Agent") != "" {
+			t.Fatalf("the caller's request was modified")
+		}
+		return string(body)
+	}
+
+	if got := fetch(nil); got != "fetcher/1.0" {
+		t.Fatalf("expected our User-Agent, got %q", got)
+	}
+	explicit := "caller/2.0"
+	if got := fetch(&explicit); got != explicit {
+		t.Fatalf("expected the caller's User-Agent, got %q", got)
+	}
+	empty := ""
+	if got := fetch(&empty); got != "" {
+		t.Fatalf("expected an empty User-Agent, got %q", got)
+	}
+}
+
+// Test that the methods used may be restricted.
+func TestAllowedMethods(t *testing.T) {
+
+	var mutex sync.Mutex
+	var methods []string
+	srv, port := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		methods = append(methods, r.Method)
+		mutex.Unlock()
+	}))
+	defer srv.Close()
+
+	opts := DefaultOptions()
+	opts.AllowCIDRs = []string{"127.0.0.1/32"}
+	opts.AllowedMethods = []string{"GET", "head"}
+
+	c, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %s", err.Error())
+	}
+
+	u := "http://127.0.0.1:" + port + "/"
+	for _, method := range []string{"GET", "HEAD", ""} {
+		req, _ := http.NewRequest(method, u, nil)
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error with method %q: %s", method, err.Error())
+		}
+		resp.Body.Close()
+	}
+
+	_, err = c.Post(u, "text/plain", strings.NewReader("data"))
+	if err == nil || !strings.Contains(err.Error(), "uses method POST, which is denied") {
+		t.Fatalf("expected POST to be refused, got %v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if strings.Join(methods, ",") != "GET,HEAD,GET" {
+		t.Fatalf("unexpected methods received %v", methods)
+	}
+}
+
+// Test that compressed responses can't expand beyond our limits.
+func TestDecompressionBomb(t *testing.T) {
+
+	// Ten megabytes of zeros compress to around ten kilobytes.
+	var bomb bytes.Buffer
+	z := gzip.NewWriter(&bomb)
+	z.Write(make([]byte, 10*1024*1024))
+	z.Close()
+
+	srv, port := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(bomb.Len()))
+		w.Write(bomb.Bytes())
+	}))
+	defer srv.Close()
+
+	for _, disable := range []bool{false, true} {
+
+		opts := DefaultOptions()
+		opts.AllowCIDRs = []string{"127.0.0.1/32"}
+		opts.MaxResponseBytes = 1024 * 1024
+		opts.DisableCompression = disable
+
+		c, err := NewClient(opts)
+		if err != nil {
+			t.Fatalf("unexpected error creating client: %s", err.Error())
+		}
+
+		resp, err := c.Get("http://127.0.0.1:" + port + "/")
+		if err != nil {
+			t.Fatalf("unexpected error making request: %s", err.Error())
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		// The decompressed body exceeds our limit.
+		if !disable {
+			if !resp.Uncompressed {
+				t.Fatalf("expected the response to be decompressed")
+			}
+			if err == nil || !strings.Contains(err.Error(), "exceeds the limit of 1048576 bytes") {
+				t.Fatalf("expected the limit to be exceeded, got %v", err)
+			}
+			if len(body) != 1024*1024 {
+				t.Fatalf("expected to read up to the limit, got %d bytes", len(body))
+			}
+			continue
+		}
+
+		// Without compression we receive the body unchanged.
+		if err != nil {
+			t.Fatalf("unexpected error reading body: %s", err.Error())
+		}
+		if resp.Uncompressed || resp.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal(body, bomb.Bytes()) {
+			t.Fatalf("expected the compressed body, got %d bytes", len(body))
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package remotehttp
+
+import "time"
+
+// clock returns the current time.
+//
+// Our pin cache, byte budgets, and interface-address refreshes use this
+// rather than calling time.Now directly, so that tests may replace it and
+// test expiry deterministically, without sleeping.
+var clock = time.Now
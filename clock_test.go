@@ -0,0 +1,66 @@
+package remotehttp
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock which only moves when advanced.
+type fakeClock struct {
+
+	// Lock for our time.
+	mutex sync.Mutex
+
+	// The current time.
+	now time.Time
+}
+
+// useFakeClock replaces our clock with a fake one, returning it and a
+// function to restore the real clock.
+func useFakeClock() (*fakeClock, func()) {
+
+	f := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	orig := clock
+	clock = f.Now
+	return f, func() { clock = orig }
+}
+
+// Now returns the current (fake) time.
+func (f *fakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.now
+}
+
+// Advance moves the clock forward by the given duration.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.now = f.now.Add(d)
+}
+
+// Test that our fake clock only moves when advanced.
+func TestFakeClock(t *testing.T) {
+
+	f, restore := useFakeClock()
+	defer restore()
+
+	start := clock()
+	if !clock().Equal(start) {
+		t.Fatalf("expected the clock to be stopped")
+	}
+
+	f.Advance(time.Hour)
+	if clock().Sub(start) != time.Hour {
+		t.Fatalf("expected the clock to advance by an hour, got %s", clock().Sub(start))
+	}
+
+	restore()
+	if time.Since(clock()) > time.Minute {
+		t.Fatalf("expected the real clock to be restored")
+	}
+}
@@ -0,0 +1,121 @@
+package remotehttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OptionsFromJSON reads a policy document, in JSON, and returns the
+// Options it describes.
+//
+// The document is an object whose keys are the names of the fields of
+// Options, such as:
+//
+//	{
+//	  "AllowCIDRs": ["10.1.0.0/16"],
+//	  "DeniedPorts": [25, 6379],
+//	  "AllowedSchemes": ["https"],
+//	  "ResolveTimeout": "2s",
+//	  "Proxy": "http://proxy.example.com:3128/"
+//	}
+//
+// Durations may be given as strings, such as "1m30s", or as a number of
+// nanoseconds, and the Proxy as a URL.  Options which are functions or
+// interfaces, such as Resolver and OnBlock, can't be set this way and are
+// rejected, as are unknown keys.  The options are validated as NewClient
+// would validate them, so an invalid policy fails when it is loaded,
+// rather than when it is first used.
+func OptionsFromJSON(r io.Reader) (Options, error) {
+
+	var opts Options
+
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return opts, fmt.Errorf("failed to parse policy: %s", err)
+	}
+
+	// Convert the values which we accept in a friendlier form than
+	// encoding/json does.
+	typ := reflect.TypeOf(opts)
+	for key, value := range doc {
+
+		field, ok := _optionsField(typ, key)
+		if !ok {
+			return opts, fmt.Errorf("unknown option %s", key)
+		}
+
+		switch {
+		case string(value) == "null":
+			delete(doc, key)
+
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			var s string
+			if json.Unmarshal(value, &s) != nil {
+				continue
+			}
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return opts, fmt.Errorf("invalid duration for %s: %s", field.Name, err)
+			}
+			doc[key], _ = json.Marshal(int64(d))
+
+		case field.Type == reflect.TypeOf(&url.URL{}):
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				return opts, fmt.Errorf("%s must be a URL", field.Name)
+			}
+			u, err := url.Parse(s)
+			if err != nil {
+				return opts, fmt.Errorf("invalid URL for %s: %s", field.Name, err)
+			}
+			opts.Proxy = u
+			delete(doc, key)
+
+		case !_isSerializable(field.Type):
+			return opts, fmt.Errorf("option %s can't be set from a policy", field.Name)
+		}
+	}
+
+	// Now decode what remains.
+	rest, _ := json.Marshal(doc)
+	dec := json.NewDecoder(bytes.NewReader(rest))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&opts); err != nil {
+		return opts, fmt.Errorf("failed to parse policy: %s", err)
+	}
+
+	// Ensure the options are valid.
+	if _, err := NewClient(opts); err != nil {
+		return opts, fmt.Errorf("invalid policy: %s", err)
+	}
+	return opts, nil
+}
+
+// _optionsField returns the field of our Options with the given name,
+// which is matched without regard to case, as encoding/json does.
+func _optionsField(typ reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		if strings.EqualFold(typ.Field(i).Name, name) {
+			return typ.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// _isSerializable returns true if values of the given type may be
+// decoded from JSON.
+func _isSerializable(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Func, reflect.Interface, reflect.Chan:
+		return false
+	case reflect.Slice, reflect.Map, reflect.Ptr:
+		return _isSerializable(typ.Elem())
+	}
+	return true
+}
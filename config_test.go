@@ -0,0 +1,65 @@
+package remotehttp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that options may be read from a policy document.
+func TestOptionsFromJSON(t *testing.T) {
+
+	policy := `{
+	  "AllowCIDRs": ["10.1.0.0/16"],
+	  "DeniedPorts": [25, 6379],
+	  "AllowedSchemes": ["https"],
+	  "ResolveTimeout": "2s",
+	  "DialTimeout": 1000000000,
+	  "pinttl": "1m",
+	  "Proxy": "http://proxy.example.com:3128/",
+	  "Resolver": null
+	}`
+
+	opts, err := OptionsFromJSON(strings.NewReader(policy))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if strings.Join(opts.AllowCIDRs, ",") != "10.1.0.0/16" || len(opts.DeniedPorts) != 2 || opts.DeniedPorts[1] != 6379 {
+		t.Fatalf("unexpected ranges %v, or ports %v", opts.AllowCIDRs, opts.DeniedPorts)
+	}
+	if strings.Join(opts.AllowedSchemes, ",") != "https" {
+		t.Fatalf("unexpected schemes %v", opts.AllowedSchemes)
+	}
+	if opts.ResolveTimeout != 2*time.Second || opts.DialTimeout != time.Second || opts.PinTTL != time.Minute {
+		t.Fatalf("unexpected durations %s, %s, %s", opts.ResolveTimeout, opts.DialTimeout, opts.PinTTL)
+	}
+	if opts.Proxy == nil || opts.Proxy.Host != "proxy.example.com:3128" {
+		t.Fatalf("unexpected proxy %v", opts.Proxy)
+	}
+
+	// The options are usable.
+	if _, err = NewTransport(opts); err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	// Invalid documents are rejected.
+	invalid := map[string]string{
+		`[]`:                               "failed to parse policy",
+		`{"AllowCIDRs": "10.0.0.0/8"}`:     "failed to parse policy",
+		`{"NoSuchOption": true}`:           "unknown option NoSuchOption",
+		`{"ResolveTimeout": "soon"}`:       "invalid duration for ResolveTimeout",
+		`{"Proxy": 3128}`:                  "Proxy must be a URL",
+		`{"Proxy": "ftp://proxy.example"}`: "invalid policy",
+		`{"OnBlock": "log"}`:               "option OnBlock can't be set from a policy",
+		`{"NamedPolicies": {}}`:            "option NamedPolicies can't be set from a policy",
+		`{"AllowCIDRs": ["10.0.0.0/33"]}`:  "invalid policy",
+		`{"ResolveTimeout": "-1s"}`:        "invalid policy",
+		`{"ClientTimeout": "-1s"}`:         "invalid policy",
+	}
+	for doc, expected := range invalid {
+		_, err = OptionsFromJSON(strings.NewReader(doc))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected error %q parsing %s, got %v", expected, doc, err)
+		}
+	}
+}
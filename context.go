@@ -0,0 +1,341 @@
+package remotehttp
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// contextKey is the type of the keys we store in contexts, to avoid
+// collisions with other packages.
+type contextKey int
+
+const (
+	// connInfoKey is the key for a *ConnInfo.
+	connInfoKey contextKey = iota
+
+	// connLimiterKey is the key for a *ConnLimiter.
+	connLimiterKey
+
+	// requestTimeoutKey is the key for a time.Duration.
+	requestTimeoutKey
+
+	// redirectTraceKey is the key for a *RedirectTrace.
+	redirectTraceKey
+
+	// policyNameKey is the key for a policy name.
+	policyNameKey
+
+	// fetchSpanKey is the key for a *fetchSpan.
+	fetchSpanKey
+
+	// requestPinsKey is the key for a *requestPins.
+	requestPinsKey
+
+	// blockMetadataKey is the key for a map[string]string.
+	blockMetadataKey
+)
+
+// ConnInfo describes a connection which was made by our transport.
+type ConnInfo struct {
+
+	// Host is the hostname which was requested.
+	Host string
+
+	// IP is the (validated) address which was connected to.
+	IP net.IP
+
+	// Port is the port which was connected to.
+	Port int
+
+	// Network is the network which was used, e.g. "tcp".
+	Network string
+
+	// Duration is the time taken to resolve the host and connect.
+	Duration time.Duration
+
+	// Metadata is the metadata attached to the request, if any, see
+	// WithBlockMetadata.  It should not be modified.
+	Metadata map[string]string
+}
+
+// WithConnInfo returns a context which records details of the connection
+// made for a request in the given ConnInfo.
+//
+// The ConnInfo is populated when a new connection is made; if a request
+// is made over an existing (kept-alive) connection it is not modified.
+// It should only be read once the request has completed.
+func WithConnInfo(ctx context.Context, info *ConnInfo) context.Context {
+	return context.WithValue(ctx, connInfoKey, info)
+}
+
+// connInfoFromContext returns the ConnInfo stored in the given context,
+// if any.
+func connInfoFromContext(ctx context.Context) *ConnInfo {
+	info, _ := ctx.Value(connInfoKey).(*ConnInfo)
+	return info
+}
+
+// ConnLimiter limits the number of connections which may be open at once,
+// for the requests made with a context returned by WithConnLimiter.
+//
+// This allows a job to limit the connections it makes, without a limit
+// being placed upon the transport as a whole.
+type ConnLimiter struct {
+
+	// One entry for each open connection.
+	slots chan struct{}
+}
+
+// NewConnLimiter returns a ConnLimiter which permits at most n
+// connections to be open at once.
+func NewConnLimiter(n int) *ConnLimiter {
+	if n < 1 {
+		n = 1
+	}
+	return &ConnLimiter{slots: make(chan struct{}, n)}
+}
+
+// acquire waits for a connection to be permitted, or for the context to
+// be cancelled.
+func (l *ConnLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release marks a connection as having been closed.
+func (l *ConnLimiter) release() {
+	<-l.slots
+}
+
+// WithConnLimiter returns a context which limits the connections made for
+// requests using it via the given ConnLimiter.
+//
+// A connection is counted from the time it is dialed until it is closed.
+// Note that connections which are idle, and kept-alive for re-use by the
+// transport, are still open; set DisableKeepAlives, or close the idle
+// connections, if this is a concern.
+func WithConnLimiter(ctx context.Context, limiter *ConnLimiter) context.Context {
+	return context.WithValue(ctx, connLimiterKey, limiter)
+}
+
+// connLimiterFromContext returns the ConnLimiter stored in the given
+// context, if any.
+func connLimiterFromContext(ctx context.Context) *ConnLimiter {
+	limiter, _ := ctx.Value(connLimiterKey).(*ConnLimiter)
+	return limiter
+}
+
+// limitedConn is a net.Conn which releases its ConnLimiter when closed.
+type limitedConn struct {
+	net.Conn
+
+	// The limiter we release.
+	limiter *ConnLimiter
+
+	// Ensures we only release once.
+	once sync.Once
+}
+
+// Close closes the connection, and releases our limiter.
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.limiter.release)
+	return err
+}
+
+// WithRequestTimeout returns a context which overrides the RequestTimeout
+// of our transport, for requests using it.
+//
+// This allows a single request made via a shared client, such as a large
+// download, to be given a longer (or shorter) timeout than the others.
+// Note that the timeout of the http.Client, if any, still applies; see
+// Options.RequestTimeout.  A zero duration disables the timeout.
+func WithRequestTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, requestTimeoutKey, d)
+}
+
+// requestTimeoutFromContext returns the request timeout stored in the
+// given context, if any.
+func requestTimeoutFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(requestTimeoutKey).(time.Duration)
+	return d, ok
+}
+
+// cancelBody is a response body which cancels a context when closed.
+type cancelBody struct {
+	io.ReadCloser
+
+	// The function which cancels our context.
+	cancel context.CancelFunc
+}
+
+// Close closes the body, and cancels our context.
+func (c *cancelBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// RedirectHop describes a single request made whilst following a chain of
+// redirects.
+type RedirectHop struct {
+
+	// URL is the URL which was requested.
+	URL string
+
+	// IP is the address of the server the request was sent to, which
+	// is nil if no connection was made.
+	IP net.IP
+}
+
+// RedirectTrace records the requests made whilst following a chain of
+// redirects, see WithRedirectTrace.
+type RedirectTrace struct {
+
+	// Lock for our hops.
+	mutex sync.Mutex
+
+	// The hops we've recorded.
+	hops []*RedirectHop
+}
+
+// Hops returns the requests which were made, in order.
+//
+// The first is the original request, and the last the final destination.
+func (r *RedirectTrace) Hops() []RedirectHop {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var out []RedirectHop
+	for _, hop := range r.hops {
+		out = append(out, *hop)
+	}
+	return out
+}
+
+// add records a new hop for the given URL.
+func (r *RedirectTrace) add(u string) *RedirectHop {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	hop := &RedirectHop{URL: u}
+	r.hops = append(r.hops, hop)
+	return hop
+}
+
+// setIP records the address a hop was sent to.
+func (r *RedirectTrace) setIP(hop *RedirectHop, ip net.IP) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	hop.IP = ip
+}
+
+// WithPolicyName returns a context which selects the named policy, from
+// Options.NamedPolicies, for requests using it.
+func WithPolicyName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, policyNameKey, name)
+}
+
+// policyNameFromContext returns the policy name stored in the given
+// context, if any.
+func policyNameFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(policyNameKey).(string)
+	return name, ok
+}
+
+// WithRedirectTrace returns a context which records each request made via
+// our transport in the given RedirectTrace.
+//
+// As http.Client uses the same context for each redirect it follows, this
+// allows the full path taken by a request to be logged.  Unlike ConnInfo
+// the address is recorded even if a connection is re-used.
+func WithRedirectTrace(ctx context.Context, trace *RedirectTrace) context.Context {
+	return context.WithValue(ctx, redirectTraceKey, trace)
+}
+
+// redirectTraceFromContext returns the RedirectTrace stored in the given
+// context, if any.
+func redirectTraceFromContext(ctx context.Context) *RedirectTrace {
+	trace, _ := ctx.Value(redirectTraceKey).(*RedirectTrace)
+	return trace
+}
+
+// requestPins records the addresses each host resolved to, for the
+// redirects of a single request, see WithRedirectPinning.
+type requestPins struct {
+
+	// Lock for our hosts.
+	mutex sync.Mutex
+
+	// The addresses of each (normalized) host.
+	hosts map[string][]net.IP
+}
+
+// get returns the addresses the given host resolved to, if any.
+func (r *requestPins) get(host string) []net.IP {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.hosts[host]
+}
+
+// set records the addresses the given host resolved to.
+func (r *requestPins) set(host string, ips []net.IP) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.hosts[host] = ips
+}
+
+// WithRedirectPinning returns a context which causes each host to be
+// resolved only once, for requests using it.
+//
+// As http.Client uses the same context for each redirect it follows, a
+// redirect to a host we've already resolved re-uses its addresses.  This
+// reduces the load upon DNS, and closes the window in which its records
+// could be changed to rebind the host whilst the redirects are followed.
+// The addresses are still checked whenever they're used.
+//
+// The pins last only as long as the context, so a new context should be
+// created for each request; re-using one would pin its hosts for all the
+// requests made with it.
+func WithRedirectPinning(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestPinsKey, &requestPins{hosts: make(map[string][]net.IP)})
+}
+
+// requestPinsFromContext returns the requestPins stored in the given
+// context, if any.
+func requestPinsFromContext(ctx context.Context) *requestPins {
+	pins, _ := ctx.Value(requestPinsKey).(*requestPins)
+	return pins
+}
+
+// WithBlockMetadata returns a context which attaches the given metadata
+// to requests using it.
+//
+// The metadata is passed to the OnBlock and OnConnect hooks, in the
+// Metadata of their ConnInfo, which allows denials to be tied to the
+// tenant, or request, which caused them.  The map is copied, so later
+// changes to it are not seen.
+func WithBlockMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	copied := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		copied[k] = v
+	}
+	return context.WithValue(ctx, blockMetadataKey, copied)
+}
+
+// blockMetadataFromContext returns the metadata stored in the given
+// context, if any.
+func blockMetadataFromContext(ctx context.Context) map[string]string {
+	metadata, _ := ctx.Value(blockMetadataKey).(map[string]string)
+	return metadata
+}
@@ -0,0 +1,460 @@
+package remotehttp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that connection information is recorded.
+func TestConnInfo(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	tr, err := NewTransport(Options{
+		AllowCIDRs: []string{"127.0.0.1/32"},
+		Resolver: newFakeResolver(map[string][]string{
+			"info.example": {"127.0.0.1"},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	var info ConnInfo
+	ctx := WithConnInfo(context.Background(), &info)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://info.example:"+port+"/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %s", err.Error())
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error making request: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	if info.Host != "info.example" {
+		t.Fatalf("unexpected host %s", info.Host)
+	}
+	if info.Network != "tcp" {
+		t.Fatalf("unexpected network %s", info.Network)
+	}
+	if info.IP.String() != "127.0.0.1" {
+		t.Fatalf("unexpected IP %s", info.IP)
+	}
+	if info.Duration <= 0 {
+		t.Fatalf("unexpected duration %s", info.Duration)
+	}
+	if srv.Listener.Addr().String() != info.IP.String()+":"+port {
+		t.Fatalf("connection info %v doesn't match our server %s", info, srv.Listener.Addr())
+	}
+}
+
+// Test that connections may be limited via the context.
+func TestConnLimiter(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	tr, err := NewTransport(Options{
+		AllowCIDRs: []string{"127.0.0.1/32"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	ctx := WithConnLimiter(context.Background(), NewConnLimiter(1))
+
+	// The first connection is made immediately.
+	first, err := _checker(ctx, tr, "tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf("unexpected error making connection: %s", err.Error())
+	}
+
+	// The second waits.
+	done := make(chan error, 1)
+	go func() {
+		con, err := _checker(ctx, tr, "tcp", "127.0.0.1:"+port)
+		if err == nil {
+			con.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected the second connection to wait, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Until the first is closed.
+	first.Close()
+	first.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error making second connection: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for the second connection")
+	}
+
+	// A cancelled context stops the wait.
+	first, err = _checker(ctx, tr, "tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatalf("unexpected error making connection: %s", err.Error())
+	}
+	defer first.Close()
+
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := _checker(cctx, tr, "tcp", "127.0.0.1:"+port); err == nil {
+		t.Fatalf("expected an error with a cancelled context")
+	}
+}
+
+// Test that the request timeout may be overridden via the context.
+func TestWithRequestTimeout(t *testing.T) {
+
+	srv, port := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("OK"))
+	}))
+	defer srv.Close()
+
+	opts := DefaultOptions()
+	opts.AllowCIDRs = []string{"127.0.0.1/32"}
+	opts.ClientTimeout = 0
+	opts.RequestTimeout = 100 * time.Millisecond
+
+	client, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %s", err.Error())
+	}
+
+	fetch := func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://127.0.0.1:"+port+"/", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		return err
+	}
+
+	// By default the request times out.
+	err = fetch(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Fatalf("expected the request to time out, got %v", err)
+	}
+
+	// But one request may be given longer.
+	err = fetch(WithRequestTimeout(context.Background(), 5*time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error with a longer timeout: %s", err.Error())
+	}
+
+	// Or have no timeout at all.
+	err = fetch(WithRequestTimeout(context.Background(), 0))
+	if err != nil {
+		t.Fatalf("unexpected error without a timeout: %s", err.Error())
+	}
+}
+
+// Test that our connection hooks are called.
+func TestConnectionHooks(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	var mutex sync.Mutex
+	var connected []ConnInfo
+	var blocked []ConnInfo
+	var reasons []error
+
+	tr, err := NewTransport(Options{
+		AllowCIDRs: []string{"127.0.0.1/32"},
+		Resolver: newFakeResolver(map[string][]string{
+			"hooks.example": {"127.0.0.1"},
+			"local.example": {"127.0.0.2"},
+		}),
+		DenyHostPatterns: []string{"*.denied.example"},
+		OnConnect: func(info ConnInfo) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			connected = append(connected, info)
+		},
+		OnBlock: func(info ConnInfo, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			blocked = append(blocked, info)
+			reasons = append(reasons, err)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	resp, err := client.Get("http://hooks.example:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error making request: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	for _, host := range []string{"local.example", "www.denied.example", "missing.example"} {
+		if _, err = client.Get("http://" + host + ":" + port + "/"); err == nil {
+			t.Fatalf("expected error requesting %s", host)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(connected) != 1 {
+		t.Fatalf("expected one connection, got %d", len(connected))
+	}
+	info := connected[0]
+	if info.Host != "hooks.example" || !info.IP.Equal(net.ParseIP("127.0.0.1")) || strconv.Itoa(info.Port) != port || info.Network != "tcp" {
+		t.Fatalf("unexpected connection details %+v", info)
+	}
+	if info.Duration <= 0 || info.Duration > 5*time.Second {
+		t.Fatalf("implausible connection duration %s", info.Duration)
+	}
+
+	// Resolution failures aren't blocks.
+	if len(blocked) != 2 {
+		t.Fatalf("expected two blocks, got %+v", blocked)
+	}
+	if blocked[0].Host != "local.example" || !blocked[0].IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("unexpected block details %+v", blocked[0])
+	}
+	if !strings.Contains(reasons[0].Error(), "denied as local") {
+		t.Fatalf("unexpected block reason %s", reasons[0])
+	}
+	if blocked[1].Host != "www.denied.example" || blocked[1].IP != nil {
+		t.Fatalf("unexpected block details %+v", blocked[1])
+	}
+
+	// Without hooks nothing is called.
+	tr, err = NewTransport(Options{AllowCIDRs: []string{"127.0.0.1/32"}})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client = &http.Client{Transport: tr, Timeout: 5 * time.Second}
+	resp, err = client.Get("http://127.0.0.1:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error making request: %s", err.Error())
+	}
+	resp.Body.Close()
+	if _, err = client.Get("http://127.0.0.2:" + port + "/"); err == nil {
+		t.Fatalf("expected error requesting a local address")
+	}
+}
+
+// Test that redirect chains may be traced.
+func TestRedirectTrace(t *testing.T) {
+
+	mux := http.NewServeMux()
+	srv, port := testServer(t, mux)
+	defer srv.Close()
+
+	mux.Handle("/one", redirectHandler("http://two.example:"+port+"/two"))
+	mux.Handle("/two", redirectHandler("http://127.0.0.1:"+port+"/three"))
+	mux.Handle("/three", redirectHandler("/ok"))
+	mux.Handle("/ok", okHandler)
+
+	opts := DefaultOptions()
+	opts.AllowCIDRs = []string{"127.0.0.1/32"}
+	opts.Resolver = newFakeResolver(map[string][]string{
+		"one.example": {"127.0.0.1"},
+		"two.example": {"127.0.0.1"},
+	})
+	client, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %s", err.Error())
+	}
+
+	var trace RedirectTrace
+	ctx := WithRedirectTrace(context.Background(), &trace)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://one.example:"+port+"/one", nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %s", err.Error())
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error making request: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	expected := []string{
+		"http://one.example:" + port + "/one",
+		"http://two.example:" + port + "/two",
+		"http://127.0.0.1:" + port + "/three",
+		"http://127.0.0.1:" + port + "/ok",
+	}
+
+	hops := trace.Hops()
+	if len(hops) != len(expected) {
+		t.Fatalf("expected %d hops, got %+v", len(expected), hops)
+	}
+	for i, hop := range hops {
+		if hop.URL != expected[i] {
+			t.Fatalf("expected hop %d to be %s, got %s", i, expected[i], hop.URL)
+		}
+		if !hop.IP.Equal(net.ParseIP("127.0.0.1")) {
+			t.Fatalf("unexpected address for hop %d: %v", i, hop.IP)
+		}
+	}
+}
+
+// Test that a host is resolved once, whilst following redirects, if we're
+// pinning.
+func TestRedirectPinning(t *testing.T) {
+
+	mux := http.NewServeMux()
+	srv, port := testServer(t, mux)
+	defer srv.Close()
+
+	base := "http://pinned.example:" + port
+	mux.Handle("/ok", okHandler)
+	mux.Handle("/a", redirectHandler(base+"/b"))
+	mux.Handle("/b", redirectHandler(base+"/c"))
+	mux.Handle("/c", redirectHandler(base+"/ok"))
+
+	for _, pinning := range []bool{true, false} {
+
+		resolver := newFakeResolver(map[string][]string{"pinned.example": {"127.0.0.1"}})
+		tr, err := NewTransport(Options{
+			AllowCIDRs:        []string{"127.0.0.1/32"},
+			DisableKeepAlives: true,
+			Resolver:          resolver,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+		client := &http.Client{
+			Transport:     tr,
+			CheckRedirect: tr.CheckRedirect,
+			Timeout:       5 * time.Second,
+		}
+
+		fetch := func() {
+			ctx := context.Background()
+			if pinning {
+				ctx = WithRedirectPinning(ctx)
+			}
+			req, err := http.NewRequestWithContext(ctx, "GET", base+"/a", nil)
+			if err != nil {
+				t.Fatalf("unexpected error creating request: %s", err.Error())
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			resp.Body.Close()
+		}
+
+		fetch()
+		lookups := resolver.Lookups("pinned.example")
+		if pinning && lookups != 1 {
+			t.Fatalf("expected a single lookup, got %d", lookups)
+		}
+		if !pinning && lookups < 4 {
+			t.Fatalf("expected a lookup for each redirect, got %d", lookups)
+		}
+
+		// The pins last for a single request.
+		fetch()
+		if pinning && resolver.Lookups("pinned.example") != 2 {
+			t.Fatalf("expected a new request to resolve again, got %d lookups", resolver.Lookups("pinned.example"))
+		}
+	}
+}
+
+// Test that metadata attached to a request reaches our hooks.
+func TestBlockMetadata(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	var mutex sync.Mutex
+	var connected []ConnInfo
+	var blocked []ConnInfo
+
+	tr, err := NewTransport(Options{
+		AllowCIDRs: []string{"127.0.0.1/32"},
+		OnConnect: func(info ConnInfo) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			connected = append(connected, info)
+		},
+		OnBlock: func(info ConnInfo, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			blocked = append(blocked, info)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	metadata := map[string]string{"tenant": "acme", "request": "1234"}
+	ctx := WithBlockMetadata(context.Background(), metadata)
+
+	// Later changes aren't seen.
+	metadata["tenant"] = "changed"
+
+	get := func(ctx context.Context, u string) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %s", err.Error())
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err = get(ctx, "http://127.0.0.1:"+port+"/"); err != nil {
+		t.Fatalf("unexpected error making request: %s", err.Error())
+	}
+	if err = get(ctx, "http://127.0.0.2:"+port+"/"); err == nil {
+		t.Fatalf("expected error requesting a local address")
+	}
+	if err = get(context.Background(), "http://127.0.0.3:"+port+"/"); err == nil {
+		t.Fatalf("expected error requesting a local address")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(connected) != 1 || len(blocked) != 2 {
+		t.Fatalf("unexpected hook calls %+v %+v", connected, blocked)
+	}
+	for _, info := range []ConnInfo{connected[0], blocked[0]} {
+		if len(info.Metadata) != 2 || info.Metadata["tenant"] != "acme" || info.Metadata["request"] != "1234" {
+			t.Fatalf("unexpected metadata %v", info.Metadata)
+		}
+	}
+	if blocked[1].Metadata != nil {
+		t.Fatalf("unexpected metadata without a context %v", blocked[1].Metadata)
+	}
+}
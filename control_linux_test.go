@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package remotehttp
+
+import (
+	"net/http"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Test that our Control hook is invoked, after validation.
+func TestControl(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	var mutex sync.Mutex
+	var addresses []string
+
+	tr, err := NewTransport(Options{
+		AllowCIDRs: []string{"127.0.0.1/32"},
+		Resolver: newFakeResolver(map[string][]string{
+			"control.example": {"127.0.0.1"},
+			"local.example":   {"127.0.0.2"},
+		}),
+		Control: func(network, address string, c syscall.RawConn) error {
+			mutex.Lock()
+			addresses = append(addresses, address)
+			mutex.Unlock()
+
+			// Apply a socket option, as a real hook would.
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	resp, err := client.Get("http://control.example:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error making request: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	// Denied hosts never reach the hook.
+	_, err = client.Get("http://local.example:" + port + "/")
+	if err == nil {
+		t.Fatalf("expected error requesting a local address")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(addresses) != 1 || addresses[0] != "127.0.0.1:"+port {
+		t.Fatalf("unexpected addresses passed to our hook: %v", addresses)
+	}
+}
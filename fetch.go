@@ -0,0 +1,96 @@
+package remotehttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// SafeGet fetches the given URL, returning its body and headers.
+//
+// This packages the common pattern of fetching a user-supplied URL, such
+// as when rendering a document.  The URL is validated via IsSafeURL, then
+// fetched via a client created by NewClient with the given options, such
+// that its locality is checked once more when connecting, and the limits
+// configured by MaxResponseBytes, AllowedContentTypes, and the various
+// timeouts, apply.  Responses which don't have a 2xx status are errors.
+//
+// The caller must close the returned body.
+func SafeGet(ctx context.Context, rawurl string, opts Options) (io.ReadCloser, http.Header, error) {
+	return _fetch(ctx, "GET", rawurl, nil, opts)
+}
+
+// SafePost sends the given body to the given URL, returning the body and
+// headers of the response.
+//
+// This is the counterpart of SafeGet, for pushing a document to a remote
+// service.  The URL is validated before any of the body is read, and the
+// body is then streamed to the server, so that large bodies needn't be
+// held in memory; the timeouts configured by our options apply as they
+// would to a fetch.  Responses which don't have a 2xx status are errors.
+//
+// The caller must close the returned body.
+func SafePost(ctx context.Context, rawurl string, body io.Reader, opts Options) (io.ReadCloser, http.Header, error) {
+	return _fetch(ctx, "POST", rawurl, body, opts)
+}
+
+// _fetch makes a request for SafeGet or SafePost.
+func _fetch(ctx context.Context, method, rawurl string, body io.Reader, opts Options) (io.ReadCloser, http.Header, error) {
+
+	client, err := NewClient(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := client.Transport.(*clientTransport)
+
+	// The client isn't re-used, so close its connections when we
+	// return, unless the body is handed to our caller.
+	done := false
+	defer func() {
+		if !done {
+			c.CloseIdleConnections()
+		}
+	}()
+
+	// Validate the URL before we attempt to fetch it.
+	err = c.transport.IsSafeURL(ctx, rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, rawurl, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("fetching %s returned status %s", req.URL.Redacted(), resp.Status)
+	}
+
+	done = true
+	return &fetchBody{ReadCloser: resp.Body, client: client}, resp.Header, nil
+}
+
+// fetchBody is the body returned by SafeGet and SafePost, which closes
+// the idle connections of its client once it is closed, as the client
+// isn't re-used.
+type fetchBody struct {
+	io.ReadCloser
+
+	// The client which fetched the body.
+	client *http.Client
+}
+
+// Close closes the body, and the idle connections of our client.
+func (f *fetchBody) Close() error {
+	err := f.ReadCloser.Close()
+	f.client.CloseIdleConnections()
+	return err
+}
@@ -0,0 +1,232 @@
+package remotehttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test fetching URLs safely.
+func TestSafeGet(t *testing.T) {
+
+	mux := http.NewServeMux()
+	srv, port := testServer(t, mux)
+	defer srv.Close()
+
+	mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<p>hello</p>"))
+	})
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("PNG"))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write(bytes.Repeat([]byte("x"), 2048))
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		for i := 0; i < 4; i++ {
+			w.Write(bytes.Repeat([]byte("x"), 512))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<p>not found</p>"))
+	})
+	mux.Handle("/redirect", redirectHandler("/html"))
+
+	opts := DefaultOptions()
+	opts.AllowCIDRs = []string{"127.0.0.1/32"}
+	opts.MaxResponseBytes = 1024
+	opts.AllowedContentTypes = []string{"TEXT/HTML"}
+
+	base := "http://127.0.0.1:" + port
+
+	// A permitted fetch, following a redirect.
+	body, header, err := SafeGet(context.Background(), base+"/redirect", opts)
+	if err != nil {
+		t.Fatalf("unexpected error fetching: %s", err.Error())
+	}
+	out, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(out) != "<p>hello</p>" {
+		t.Fatalf("unexpected body %q, error %v", out, err)
+	}
+	if !strings.HasPrefix(header.Get("Content-Type"), "text/html") {
+		t.Fatalf("unexpected headers %v", header)
+	}
+
+	// A streamed body which exceeds our limit fails while reading.
+	body, _, err = SafeGet(context.Background(), base+"/stream", opts)
+	if err != nil {
+		t.Fatalf("unexpected error fetching: %s", err.Error())
+	}
+	out, err = io.ReadAll(body)
+	body.Close()
+	if err == nil || !strings.Contains(err.Error(), "exceeds the limit of 1024 bytes") {
+		t.Fatalf("expected the limit to be exceeded, got %v", err)
+	}
+	if len(out) != 1024 {
+		t.Fatalf("expected 1024 bytes to be read, got %d", len(out))
+	}
+
+	tests := map[string]string{
+		base + "/large":                  "has length 2048, which exceeds the limit",
+		base + "/image":                  `has content-type "image/png", which is denied`,
+		base + "/missing":                "returned status 404",
+		"http://127.0.0.2:" + port + "/": "denied as local",
+		"ftp://127.0.0.1/":               "scheme ftp, which is denied",
+	}
+
+	for u, expected := range tests {
+		_, _, err = SafeGet(context.Background(), u, opts)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected error %q fetching %s, got %v", expected, u, err)
+		}
+	}
+
+	// Invalid options are rejected.
+	_, _, err = SafeGet(context.Background(), base+"/html", Options{MaxResponseBytes: -1})
+	if err == nil {
+		t.Fatalf("expected error with invalid options")
+	}
+}
+
+// readRecorder is an io.Reader which records whether it has been read.
+type readRecorder struct {
+	io.Reader
+	read bool
+}
+
+func (r *readRecorder) Read(p []byte) (int, error) {
+	r.read = true
+	return r.Reader.Read(p)
+}
+
+// Test posting bodies safely.
+func TestSafePost(t *testing.T) {
+
+	// A handler which reports the size of the body it received.
+	srv, port := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%d", n)
+	}))
+	defer srv.Close()
+
+	opts := DefaultOptions()
+	opts.InsecureAllowLoopbackForTesting = true
+
+	// A large body is streamed to the server.
+	size := int64(32 << 20)
+	upload := &readRecorder{Reader: io.LimitReader(zeroReader{}, size)}
+	body, _, err := SafePost(context.Background(), "http://127.0.0.1:"+port+"/", upload, opts)
+	if err != nil {
+		t.Fatalf("unexpected error posting: %s", err.Error())
+	}
+	out, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(out) != fmt.Sprintf("%d", size) {
+		t.Fatalf("unexpected response %q, error %v", out, err)
+	}
+
+	// A denied target fails before the body is read.
+	upload = &readRecorder{Reader: strings.NewReader("secrets")}
+	_, _, err = SafePost(context.Background(), "http://127.0.0.1:"+port+"/", upload, DefaultOptions())
+	if err == nil {
+		t.Fatalf("expected error posting to a local address")
+	}
+	if upload.read {
+		t.Fatalf("expected the body not to be read")
+	}
+}
+
+// zeroReader is an io.Reader which returns zeros, forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// Test that failed fetches don't leave their connections open.
+func TestSafeGetClosesConnections(t *testing.T) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("PNG"))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", "2048")
+		w.Write(bytes.Repeat([]byte("x"), 2048))
+	})
+	mux.Handle("/redirect", redirectHandler("http://10.0.0.1/"))
+
+	// Count the connections which are open.
+	var mutex sync.Mutex
+	open := 0
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch state {
+		case http.StateNew:
+			open++
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	opts := DefaultOptions()
+	opts.AllowCIDRs = []string{"127.0.0.1/32"}
+	opts.MaxResponseBytes = 1024
+	opts.AllowedContentTypes = []string{"text/html"}
+
+	for i := 0; i < 20; i++ {
+		for _, path := range []string{"/image", "/large", "/redirect"} {
+			if _, _, err := SafeGet(context.Background(), srv.URL+path, opts); err == nil {
+				t.Fatalf("expected error fetching %s", path)
+			}
+		}
+	}
+
+	// The server sees the connections close shortly afterwards.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		n := open
+		mutex.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected all connections to be closed, %d are open", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
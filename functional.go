@@ -0,0 +1,154 @@
+package remotehttp
+
+import (
+	"fmt"
+	"time"
+)
+
+// Option is a function which configures a SafeTransport created via New.
+type Option func(*Options) error
+
+// New creates a new SafeTransport, configured by the given options.
+//
+// The options are applied, in order, to the result of DefaultOptions.  An
+// error is returned if any option fails, or if the resulting options are
+// invalid.  Calling New with no options is equivalent to using
+// DefaultOptions.
+func New(opts ...Option) (*SafeTransport, error) {
+
+	options := DefaultOptions()
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return nil, err
+		}
+	}
+	return NewTransport(options)
+}
+
+// WithOptions replaces all the options with the given ones.
+//
+// This is useful to start from a set of options loaded elsewhere.
+func WithOptions(o Options) Option {
+	return func(opts *Options) error {
+		*opts = o
+		return nil
+	}
+}
+
+// WithAllowCIDRs adds the given network ranges to those which are allowed.
+func WithAllowCIDRs(cidrs ...string) Option {
+	return func(opts *Options) error {
+		opts.AllowCIDRs = append(opts.AllowCIDRs, cidrs...)
+		return nil
+	}
+}
+
+// WithDenyCIDRs adds the given network ranges to those which are denied.
+func WithDenyCIDRs(cidrs ...string) Option {
+	return func(opts *Options) error {
+		opts.DenyCIDRs = append(opts.DenyCIDRs, cidrs...)
+		return nil
+	}
+}
+
+// WithExcludeCIDRs adds the given built-in ranges to those which are no
+// longer denied.
+func WithExcludeCIDRs(cidrs ...string) Option {
+	return func(opts *Options) error {
+		opts.ExcludeCIDRs = append(opts.ExcludeCIDRs, cidrs...)
+		return nil
+	}
+}
+
+// WithAllowHosts adds the given hostnames to those which are allowed.
+func WithAllowHosts(hosts ...string) Option {
+	return func(opts *Options) error {
+		opts.AllowHosts = append(opts.AllowHosts, hosts...)
+		return nil
+	}
+}
+
+// WithDenyHostPatterns adds the given patterns to those which are denied.
+func WithDenyHostPatterns(patterns ...string) Option {
+	return func(opts *Options) error {
+		opts.DenyHostPatterns = append(opts.DenyHostPatterns, patterns...)
+		return nil
+	}
+}
+
+// WithDeniedPorts adds the given ports to those which are denied.
+func WithDeniedPorts(ports ...int) Option {
+	return func(opts *Options) error {
+		opts.DeniedPorts = append(opts.DeniedPorts, ports...)
+		return nil
+	}
+}
+
+// WithMetadataBlocking enables the blocking of cloud metadata endpoints.
+//
+// If no addresses are given then DefaultMetadataIPs are blocked.
+func WithMetadataBlocking(ips ...string) Option {
+	return func(opts *Options) error {
+		opts.BlockMetadataEndpoints = true
+		opts.MetadataIPs = append(opts.MetadataIPs, ips...)
+		return nil
+	}
+}
+
+// WithDialTimeout sets the maximum time to spend connecting to a host.
+func WithDialTimeout(d time.Duration) Option {
+	return func(opts *Options) error {
+		if d <= 0 {
+			return fmt.Errorf("dial timeout must be positive")
+		}
+		opts.DialTimeout = d
+		return nil
+	}
+}
+
+// WithResolveTimeout sets the maximum time to spend resolving a host.
+func WithResolveTimeout(d time.Duration) Option {
+	return func(opts *Options) error {
+		if d <= 0 {
+			return fmt.Errorf("resolve timeout must be positive")
+		}
+		opts.ResolveTimeout = d
+		return nil
+	}
+}
+
+// WithResolver sets the resolver used to resolve hostnames.
+func WithResolver(r Resolver) Option {
+	return func(opts *Options) error {
+		if r == nil {
+			return fmt.Errorf("resolver must not be nil")
+		}
+		opts.Resolver = r
+		return nil
+	}
+}
+
+// WithPinning enables the pinning of hosts to their validated addresses,
+// for the given duration.
+func WithPinning(ttl time.Duration) Option {
+	return func(opts *Options) error {
+		if ttl <= 0 {
+			return fmt.Errorf("pin TTL must be positive")
+		}
+		opts.PinTTL = ttl
+		return nil
+	}
+}
+
+// AllowLoopbackForTesting permits connections to loopback addresses, so
+// that code using this package may be tested against servers created via
+// httptest.
+//
+// As the name suggests this is insecure, and must never be used outside
+// of tests; see Options.InsecureAllowLoopbackForTesting.
+func AllowLoopbackForTesting() Option {
+	return func(opts *Options) error {
+		opts.InsecureAllowLoopbackForTesting = true
+		return nil
+	}
+}
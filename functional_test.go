@@ -0,0 +1,159 @@
+package remotehttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test creating a transport with no options.
+func TestNew(t *testing.T) {
+
+	tr, err := New()
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	if tr.options.ClientTimeout != 30*time.Second {
+		t.Fatalf("expected the default options to be used")
+	}
+	if tr.dialler.Timeout != 30*time.Second {
+		t.Fatalf("unexpected dial timeout %s", tr.dialler.Timeout)
+	}
+}
+
+// Test composing multiple options.
+func TestNewOptions(t *testing.T) {
+
+	resolver := newFakeResolver(map[string][]string{
+		"internal.example": {"10.1.1.1"},
+	})
+
+	tr, err := New(
+		WithAllowCIDRs("10.0.0.0/8"),
+		WithAllowCIDRs("192.168.0.0/16"),
+		WithDenyCIDRs("8.8.8.0/24"),
+		WithExcludeCIDRs("100.64.0.0/10"),
+		WithDenyHostPatterns("*.evil.example"),
+		WithDeniedPorts(22, 25),
+		WithMetadataBlocking(),
+		WithDialTimeout(5*time.Second),
+		WithResolveTimeout(time.Second),
+		WithResolver(resolver),
+		WithPinning(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	if tr.dialler.Timeout != 5*time.Second {
+		t.Fatalf("unexpected dial timeout %s", tr.dialler.Timeout)
+	}
+	if tr.options.ResolveTimeout != time.Second {
+		t.Fatalf("unexpected resolve timeout %s", tr.options.ResolveTimeout)
+	}
+	if tr.pins == nil {
+		t.Fatalf("expected pinning to be enabled")
+	}
+
+	// Both allowed ranges are present.
+	for _, ip := range []string{"10.1.1.1", "192.168.1.1", "100.64.1.1"} {
+		if err = tr.checkIP(net.ParseIP(ip)); err != nil {
+			t.Fatalf("unexpected error checking %s: %s", ip, err.Error())
+		}
+	}
+	for _, ip := range []string{"8.8.8.8", "169.254.169.254", "127.0.0.1"} {
+		if err = tr.checkIP(net.ParseIP(ip)); err == nil {
+			t.Fatalf("expected error checking %s", ip)
+		}
+	}
+
+	// The resolver is used.
+	if err = tr.IsSafeURL(context.Background(), "http://internal.example/"); err != nil {
+		t.Fatalf("unexpected error validating URL: %s", err.Error())
+	}
+
+	// Hosts and ports are denied.
+	for _, u := range []string{"http://www.evil.example/", "http://internal.example:22/"} {
+		if err = tr.IsSafeURL(context.Background(), u); err == nil {
+			t.Fatalf("expected error validating %s", u)
+		}
+	}
+}
+
+// Test that invalid options are rejected.
+func TestNewInvalid(t *testing.T) {
+
+	tests := map[string][]Option{
+		"dial timeout must be positive":    {WithDialTimeout(0)},
+		"resolve timeout must be positive": {WithResolveTimeout(-time.Second)},
+		"resolver must not be nil":         {WithResolver(nil)},
+		"pin TTL must be positive":         {WithPinning(0)},
+		"failed to parse denied range":     {WithDenyCIDRs("8.8.8.8")},
+		"failed to parse allowed range":    {WithAllowCIDRs("10.0.0.0/8", "steve")},
+		"is not a built-in range":          {WithExcludeCIDRs("10.0.0.0/16")},
+		"denied port 0 is invalid":         {WithDeniedPorts(22, 0)},
+	}
+
+	for expected, opts := range tests {
+		_, err := New(opts...)
+		if err == nil {
+			t.Fatalf("expected error '%s'", expected)
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Received an error, but not the expected one.  Got: %s", err.Error())
+		}
+	}
+}
+
+// Test that WithOptions replaces the options.
+func TestWithOptions(t *testing.T) {
+
+	tr, err := New(WithDeniedPorts(22), WithOptions(Options{}), WithDeniedPorts(25))
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	if tr.checkPort("22") != nil || tr.checkPort("25") == nil {
+		t.Fatalf("expected options to be replaced")
+	}
+}
+
+// Test that loopback addresses may be permitted for testing.
+func TestAllowLoopbackForTesting(t *testing.T) {
+
+	srv := httptest.NewServer(okHandler)
+	defer srv.Close()
+
+	for _, allow := range []bool{true, false} {
+
+		var opts []Option
+		if allow {
+			opts = append(opts, AllowLoopbackForTesting())
+		}
+		tr, err := New(opts...)
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+
+		client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+		resp, err := client.Get(srv.URL)
+		if !allow {
+			if err == nil || !strings.Contains(err.Error(), "denied as local") {
+				t.Fatalf("expected loopback to be denied, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error fetching a loopback server: %s", err.Error())
+		}
+		resp.Body.Close()
+
+		// Only loopback is permitted.
+		if _, err = _validate(context.Background(), tr, "10.1.1.1", "80"); err == nil {
+			t.Fatalf("expected a private address to be denied")
+		}
+	}
+}
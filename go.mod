@@ -1,3 +1,10 @@
 module github.com/skx/remotehttp
 
-go 1.14
+go 1.17
+
+require (
+	golang.org/x/net v0.17.0
+	golang.org/x/time v0.3.0
+)
+
+require golang.org/x/text v0.13.0 // indirect
@@ -0,0 +1,194 @@
+package remotehttp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// hostProfile is used to convert internationalized hostnames to ASCII.
+//
+// It is the lookup profile without the STD3 rules, which would reject
+// names containing underscores; those are common within internal DNS.
+var hostProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false), idna.Transitional(false))
+
+// _normalizeHost converts the given hostname to a canonical form, for
+// matching and resolution.
+//
+// Hostnames are converted to lower-case, have any trailing period
+// removed, and internationalized names are converted to their ASCII
+// (punycode) form.  This ensures that `BÜCHER.example.` and
+// `xn--bcher-kva.example` are treated identically.
+//
+// IP addresses are returned unchanged, except that any IPv6 zone
+// identifier (e.g. the "%eth0" in "fe80::1%eth0") is removed, such that
+// the address can be checked against our ranges.
+func _normalizeHost(host string) (string, error) {
+
+	// Remove any zone from IPv6 addresses.
+	if i := strings.LastIndex(host, "%"); i > 0 && net.ParseIP(host[:i]) != nil {
+		host = host[:i]
+	}
+
+	// Remove any trailing period first, so that "127.1." is parsed as
+	// the address it represents.
+	host = strings.TrimSuffix(host, ".")
+
+	// IP addresses are left alone.
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+
+	// Shorthand IPv4 addresses are expanded, as some resolvers will
+	// treat them as addresses rather than names.
+	if ip := _parseShorthandIPv4(host); ip != nil {
+		return ip.String(), nil
+	}
+
+	ascii, err := hostProfile.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid hostname %s: %s", host, err)
+	}
+	return strings.ToLower(ascii), nil
+}
+
+// maxHostLength is the maximum length of a hostname, in its ASCII form.
+const maxHostLength = 253
+
+// maxLabelLength is the maximum length of a single label of a hostname.
+const maxLabelLength = 63
+
+// _checkHostname tests whether the given (normalized) hostname is
+// well-formed, so that obviously bad names are rejected before we try to
+// resolve them.
+//
+// Hostnames must be no longer than 253 characters, with labels of 1-63
+// characters, and contain only letters, digits, hyphens, and underscores.
+// IP addresses are always permitted.
+func _checkHostname(host string) error {
+
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if host == "" {
+		return fmt.Errorf("invalid hostname: the hostname is empty")
+	}
+	if len(host) > maxHostLength {
+		return fmt.Errorf("invalid hostname: %d characters is longer than the maximum of %d", len(host), maxHostLength)
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return fmt.Errorf("invalid hostname %q: empty label", host)
+		}
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("invalid hostname %q: label of %d characters is longer than the maximum of %d", host, len(label), maxLabelLength)
+		}
+		for _, c := range label {
+			if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' {
+				continue
+			}
+			return fmt.Errorf("invalid hostname %q: illegal character %q", host, c)
+		}
+	}
+	return nil
+}
+
+// _matchHostPattern tests whether the given (normalized) hostname matches
+// the given (normalized) pattern.
+//
+// A pattern is either a hostname, which must match exactly, or a hostname
+// prefixed by `*.` which matches any subdomain of that name.
+func _matchHostPattern(host, pattern string) bool {
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// _normalizePatterns normalizes the given list of host patterns.
+func _normalizePatterns(patterns []string) ([]string, error) {
+
+	var out []string
+	for _, pattern := range patterns {
+
+		prefix := ""
+		if strings.HasPrefix(pattern, "*.") {
+			prefix = "*."
+			pattern = pattern[2:]
+		}
+
+		host, err := _normalizeHost(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			return nil, fmt.Errorf("host patterns must not be empty")
+		}
+		out = append(out, prefix+host)
+	}
+	return out, nil
+}
+
+// _parseShorthandIPv4 parses the shorthand forms of IPv4 addresses which
+// are accepted by inet_aton(3), returning nil if the given host isn't one.
+//
+// These include addresses with fewer than four parts, such as "127.1" or
+// "10.1", and parts expressed in octal or hex, such as "0177.0.0.1" or
+// "0x7f.1".  Go's parser rejects these, but they'd be accepted by other
+// parsers, and resolvers, so we need to treat them as the addresses they
+// represent.
+func _parseShorthandIPv4(host string) net.IP {
+
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return nil
+	}
+
+	// Parse each part, in decimal, hex, or octal.
+	values := make([]uint64, len(parts))
+	for i, part := range parts {
+
+		base := 10
+		switch {
+		case strings.HasPrefix(part, "0x") || strings.HasPrefix(part, "0X"):
+			base = 16
+			part = part[2:]
+		case len(part) > 1 && part[0] == '0':
+			base = 8
+			part = part[1:]
+		}
+
+		// ParseUint permits a leading sign, and underscores,
+		// which aren't valid addresses.
+		if part == "" || strings.ContainsAny(part, "+-_") {
+			return nil
+		}
+
+		v, err := strconv.ParseUint(part, base, 32)
+		if err != nil {
+			return nil
+		}
+		values[i] = v
+	}
+
+	// The final part fills all the remaining bytes, the
+	// others must each fit in a single byte.
+	last := values[len(values)-1]
+	if last >= 1<<(8*uint(5-len(values))) {
+		return nil
+	}
+	addr := last
+	for i, v := range values[:len(values)-1] {
+		if v > 255 {
+			return nil
+		}
+		addr |= v << (8 * uint(3-i))
+	}
+
+	return net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr))
+}
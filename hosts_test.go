@@ -0,0 +1,340 @@
+package remotehttp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Test that hostnames are normalized.
+func TestNormalizeHost(t *testing.T) {
+
+	tests := map[string]string{
+		"example.com":            "example.com",
+		"EXAMPLE.com.":           "example.com",
+		"bücher.example":         "xn--bcher-kva.example",
+		"BÜCHER.example":         "xn--bcher-kva.example",
+		"xn--bcher-kva.example":  "xn--bcher-kva.example",
+		"127.0.0.1":              "127.0.0.1",
+		"2001:db8::1":            "2001:db8::1",
+		"www.xn--bcher-kva.test": "www.xn--bcher-kva.test",
+		"My_Service.internal":    "my_service.internal",
+		"_sip._tcp.example.":     "_sip._tcp.example",
+	}
+
+	for input, expected := range tests {
+		out, err := _normalizeHost(input)
+		if err != nil {
+			t.Fatalf("unexpected error normalizing %s: %s", input, err.Error())
+		}
+		if out != expected {
+			t.Fatalf("normalizing %s gave %s, not %s", input, out, expected)
+		}
+	}
+}
+
+// Test that denied host patterns match both forms of an IDN.
+func TestDenyHostPatterns(t *testing.T) {
+
+	for _, pattern := range []string{"bücher.example", "xn--bcher-kva.example", "*.Bücher.example"} {
+
+		tr, err := NewTransport(Options{
+			DenyHostPatterns: []string{pattern},
+			Resolver:         newFakeResolver(nil),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+
+		hosts := []string{"bücher.example", "xn--bcher-kva.example", "BÜCHER.EXAMPLE."}
+		if strings.HasPrefix(pattern, "*.") {
+			hosts = []string{"www.bücher.example", "www.xn--bcher-kva.example"}
+		}
+
+		for _, host := range hosts {
+			_, err = tr.DialContext(context.Background(), "tcp", host+":80")
+			if err == nil {
+				t.Fatalf("expected error dialing %s", host)
+			}
+			if !strings.Contains(err.Error(), "denied by pattern") {
+				t.Fatalf("Received an error dialing %s, but not the expected one.  Got: %s", host, err.Error())
+			}
+		}
+	}
+
+	// Other hosts are not denied by the pattern.
+	tr, err := NewTransport(Options{
+		DenyHostPatterns: []string{"*.bücher.example"},
+		Resolver:         newFakeResolver(nil),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	for _, host := range []string{"bücher.example", "xbücher.example", "bücher.example.com"} {
+		_, err = tr.DialContext(context.Background(), "tcp", host+":80")
+		if err == nil || strings.Contains(err.Error(), "denied by pattern") {
+			t.Fatalf("expected lookup error dialing %s, got %v", host, err)
+		}
+	}
+}
+
+// Test that IPv6 zones are handled.
+func TestIPv6Zones(t *testing.T) {
+
+	out, err := _normalizeHost("fe80::1%eth0")
+	if err != nil {
+		t.Fatalf("unexpected error normalizing: %s", err.Error())
+	}
+	if out != "fe80::1" {
+		t.Fatalf("unexpected result normalizing: %s", out)
+	}
+
+	tr, err := NewTransport(Options{Resolver: newFakeResolver(nil)})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	for _, addr := range []string{"[fe80::1%eth0]:80", "[fe80::1%25eth0]:80", "[::1%lo]:80", "[ff02::1%1]:80"} {
+		_, err = tr.DialContext(context.Background(), "tcp", addr)
+		if err == nil {
+			t.Fatalf("expected error dialing %s", addr)
+		}
+		if !strings.Contains(err.Error(), "denied as local") {
+			t.Fatalf("Received an error dialing %s, but not the expected one.  Got: %s", addr, err.Error())
+		}
+	}
+
+	err = tr.IsSafeURL(context.Background(), "http://[fe80::1%25eth0]:6379/")
+	if err == nil || !strings.Contains(err.Error(), "denied as local") {
+		t.Fatalf("expected zoned URL to be denied, got %v", err)
+	}
+}
+
+// Test that shorthand IPv4 addresses are expanded.
+func TestShorthandIPv4(t *testing.T) {
+
+	tests := map[string]string{
+		"127.1":         "127.0.0.1",
+		"10.1":          "10.0.0.1",
+		"0x7f.1":        "127.0.0.1",
+		"0177.0.0.1":    "127.0.0.1",
+		"2130706433":    "127.0.0.1",
+		"0x7f000001":    "127.0.0.1",
+		"127.0.1":       "127.0.0.1",
+		"169.254.43518": "169.254.169.254",
+		"010.0.0.1":     "8.0.0.1",
+		"127.1.":        "127.0.0.1",
+		"0x7f.1.":       "127.0.0.1",
+		"127.0.0.1.":    "127.0.0.1",
+	}
+
+	for input, expected := range tests {
+		out, err := _normalizeHost(input)
+		if err != nil {
+			t.Fatalf("unexpected error normalizing %s: %s", input, err.Error())
+		}
+		if out != expected {
+			t.Fatalf("normalizing %s gave %s, not %s", input, out, expected)
+		}
+	}
+
+	// Things which aren't addresses.
+	for _, input := range []string{"example.com", "1.2.3.4.5", "256.1", "1.16777216", "0x.1", "08.1", "1..2", "123abc", "1_0.1", "0b1.1", "+1.1"} {
+		if _parseShorthandIPv4(input) != nil {
+			t.Fatalf("unexpectedly parsed %s as an address", input)
+		}
+	}
+
+	// And that they're denied.
+	tr, err := NewTransport(Options{Resolver: newFakeResolver(nil)})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	for _, host := range []string{"127.1", "10.1", "0x7f.1"} {
+		_, err = tr.DialContext(context.Background(), "tcp", host+":80")
+		if err == nil {
+			t.Fatalf("expected error dialing %s", host)
+		}
+		if !strings.Contains(err.Error(), "denied as local") {
+			t.Fatalf("Received an error dialing %s, but not the expected one.  Got: %s", host, err.Error())
+		}
+	}
+}
+
+// Test that allowed host patterns work in allowlist-only mode.
+func TestAllowHostPatterns(t *testing.T) {
+
+	tr, err := NewTransport(Options{
+		AllowHostPatterns: []string{"*.Partner.example.", "exact.example"},
+		AllowCIDRs:        []string{"192.0.2.0/24"},
+		AllowlistOnly:     true,
+		Resolver: newFakeResolver(map[string][]string{
+			"api.partner.example":      {"1.1.1.1"},
+			"internal.partner.example": {"10.0.0.1"},
+			"partner.example":          {"1.1.1.2"},
+			"exact.example":            {"1.1.1.3"},
+			"other.example":            {"1.1.1.4"},
+			"ranged.example":           {"192.0.2.1"},
+			"mixed.example":            {"192.0.2.1,1.1.1.5"},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	tests := map[string]string{
+		"API.partner.example.":     "",
+		"internal.partner.example": "",
+		"exact.example":            "",
+		"ranged.example":           "",
+		"partner.example":          "host partner.example is not allowed",
+		"other.example":            "host other.example is not allowed",
+		"mixed.example":            "1.1.1.5 is not in an allowed range",
+		"8.8.8.8":                  "host 8.8.8.8 is not allowed",
+	}
+
+	for host, expected := range tests {
+		_, err = _validate(context.Background(), tr, host, "80")
+		if expected == "" {
+			if err != nil {
+				t.Fatalf("unexpected error validating %s: %s", host, err.Error())
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected error %q validating %s, got %v", expected, host, err)
+		}
+	}
+
+	// Without an allowed range hosts are denied before resolution.
+	resolver := newFakeResolver(map[string][]string{
+		"other.example": {"1.1.1.4"},
+	})
+	tr, err = NewTransport(Options{
+		AllowHostPatterns: []string{"*.partner.example"},
+		AllowlistOnly:     true,
+		Resolver:          resolver,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	_, err = _validate(context.Background(), tr, "other.example", "80")
+	if err == nil || !strings.Contains(err.Error(), "host other.example is not allowed") {
+		t.Fatalf("expected the host to be denied, got %v", err)
+	}
+	if resolver.Lookups("other.example") != 0 {
+		t.Fatalf("expected the host to be denied before resolution")
+	}
+
+	// Invalid patterns are rejected.
+	_, err = NewTransport(Options{AllowHostPatterns: []string{"*."}})
+	if err == nil {
+		t.Fatalf("expected error with an invalid pattern")
+	}
+}
+
+// Test that hosts may be denied by their TLD.
+func TestDenyTLDs(t *testing.T) {
+
+	resolver := newFakeResolver(map[string][]string{
+		"something.localhost":  {"1.1.1.1"},
+		"foo.internal":         {"1.1.1.1"},
+		"printer.home.arpa":    {"1.1.1.1"},
+		"foo.corp":             {"1.1.1.1"},
+		"internal.example.com": {"1.1.1.1"},
+		"www.example.com":      {"1.1.1.1"},
+	})
+
+	type TestCase struct {
+		opts     Options
+		host     string
+		expected string
+	}
+
+	tests := []TestCase{
+		{Options{}, "something.localhost", ""},
+		{Options{DenySpecialUseTLDs: true}, "something.localhost", "within the TLD localhost"},
+		{Options{DenySpecialUseTLDs: true}, "FOO.Internal.", "within the TLD internal"},
+		{Options{DenySpecialUseTLDs: true}, "printer.home.arpa", "within the TLD home.arpa"},
+		{Options{DenySpecialUseTLDs: true}, "internal.example.com", ""},
+		{Options{DenySpecialUseTLDs: true}, "www.example.com", ""},
+		{Options{DenyTLDs: []string{".corp"}}, "foo.corp", "within the TLD corp"},
+		{Options{DenyTLDs: []string{"corp"}}, "foo.internal", ""},
+		{Options{DenyTLDs: []string{"corp"}, DenySpecialUseTLDs: true}, "foo.internal", "within the TLD internal"},
+	}
+
+	for _, test := range tests {
+		test.opts.Resolver = resolver
+		tr, err := NewTransport(test.opts)
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+
+		_, err = _validate(context.Background(), tr, test.host, "80")
+		if test.expected == "" {
+			if err != nil {
+				t.Fatalf("unexpected error for %s: %s", test.host, err.Error())
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("expected error %q for %s, got %v", test.expected, test.host, err)
+		}
+	}
+
+	_, err := NewTransport(Options{DenyTLDs: []string{"."}})
+	if err == nil {
+		t.Fatalf("expected error with an empty TLD")
+	}
+}
+
+// Test that malformed hostnames are rejected before they're resolved.
+func TestMalformedHosts(t *testing.T) {
+
+	long := strings.Repeat("a.", 130) + "example"
+	label := strings.Repeat("a", 64) + ".example"
+
+	tests := map[string]string{
+		long:                    "267 characters is longer than the maximum of 253",
+		label:                   "label of 64 characters is longer than the maximum of 63",
+		"bad\x00host.example":   `illegal character '\x00'`,
+		"bad\nhost.example":     `illegal character '\n'`,
+		"bad host.example":      `illegal character ' '`,
+		"bad%41host.example":    `illegal character '%'`,
+		"bad..host.example":     "empty label",
+		"":                      "the hostname is empty",
+		"good_host.example":     "",
+		"good-host.example":     "",
+		"127.0.0.1":             "",
+		strings.Repeat("a", 63): "",
+	}
+
+	resolver := newFakeResolver(map[string][]string{})
+	tr, err := NewTransport(Options{Resolver: resolver, AllowCIDRs: []string{"127.0.0.1/32"}})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	for host, expected := range tests {
+		_, err = tr.DialContext(context.Background(), "tcp", net.JoinHostPort(host, "80"))
+		if expected == "" {
+			if err != nil && strings.Contains(err.Error(), "invalid hostname") {
+				t.Fatalf("unexpected error for %q: %s", host, err.Error())
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected error %q for %q, got %v", expected, host, err)
+		}
+		if resolver.Lookups(host) != 0 {
+			t.Fatalf("didn't expect %q to be resolved", host)
+		}
+	}
+
+	// Long hostnames are rejected from URLs too.
+	err = tr.IsSafeURL(context.Background(), "http://"+long+"/")
+	if err == nil || !strings.Contains(err.Error(), "invalid hostname") {
+		t.Fatalf("expected a long hostname to be unsafe, got %v", err)
+	}
+}
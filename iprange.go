@@ -0,0 +1,67 @@
+package remotehttp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipRange is an inclusive range of IP addresses, such as those described
+// by "10.0.0.5-10.0.0.50".
+type ipRange struct {
+
+	// The first and last addresses in the range, in their 16-byte form.
+	start net.IP
+	end   net.IP
+
+	// Is this an IPv4 range?
+	ipv4 bool
+}
+
+// _parseIPRange parses a range of the form "start-end".
+//
+// Both addresses must be of the same family, and the start must not be
+// after the end.
+func _parseIPRange(entry string) (*ipRange, error) {
+
+	parts := strings.Split(entry, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("range %s is not of the form start-end", entry)
+	}
+
+	start := net.ParseIP(strings.TrimSpace(parts[0]))
+	end := net.ParseIP(strings.TrimSpace(parts[1]))
+	if start == nil || end == nil {
+		return nil, fmt.Errorf("range %s contains an invalid address", entry)
+	}
+
+	ipv4 := start.To4() != nil
+	if ipv4 != (end.To4() != nil) {
+		return nil, fmt.Errorf("range %s mixes IPv4 and IPv6 addresses", entry)
+	}
+
+	start = start.To16()
+	end = end.To16()
+	if bytes.Compare(start, end) > 0 {
+		return nil, fmt.Errorf("range %s starts after it ends", entry)
+	}
+
+	return &ipRange{start: start, end: end, ipv4: ipv4}, nil
+}
+
+// Contains tests whether the given IP address is within the range.
+func (r *ipRange) Contains(ip net.IP) bool {
+
+	if (ip.To4() != nil) != r.ipv4 {
+		return false
+	}
+
+	ip = ip.To16()
+	return bytes.Compare(ip, r.start) >= 0 && bytes.Compare(ip, r.end) <= 0
+}
+
+// String returns the range in the form "start-end".
+func (r *ipRange) String() string {
+	return r.start.String() + "-" + r.end.String()
+}
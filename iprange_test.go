@@ -0,0 +1,100 @@
+package remotehttp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// Test parsing ranges of addresses.
+func TestParseIPRange(t *testing.T) {
+
+	valid := map[string]string{
+		"10.0.0.5-10.0.0.50":       "10.0.0.5-10.0.0.50",
+		" 1.2.3.4 - 1.2.3.4 ":      "1.2.3.4-1.2.3.4",
+		"2001:db8::1-2001:db8::ff": "2001:db8::1-2001:db8::ff",
+	}
+	for entry, expected := range valid {
+		r, err := _parseIPRange(entry)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %s", entry, err.Error())
+		}
+		if r.String() != expected {
+			t.Fatalf("parsing %s gave %s, not %s", entry, r, expected)
+		}
+	}
+
+	invalid := []string{
+		"10.0.0.5",
+		"10.0.0.5-10.0.0.6-10.0.0.7",
+		"10.0.0.50-10.0.0.5",
+		"10.0.0.5-2001:db8::1",
+		"steve-kemp",
+		"10.0.0.0/8-10.0.0.5",
+	}
+	for _, entry := range invalid {
+		if _, err := _parseIPRange(entry); err == nil {
+			t.Fatalf("expected error parsing %s", entry)
+		}
+	}
+}
+
+// Test that ranges of addresses may be denied.
+func TestDenyIPRanges(t *testing.T) {
+
+	tr, err := NewTransport(Options{
+		DenyIPRanges: []string{"8.8.8.5-8.8.8.50", "2606:4700::10-2606:4700::1f"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	tests := map[string]bool{
+		"8.8.8.4":         false,
+		"8.8.8.5":         true,
+		"8.8.8.20":        true,
+		"::ffff:8.8.8.20": true,
+		"8.8.8.50":        true,
+		"8.8.8.51":        false,
+		"2606:4700::f":    false,
+		"2606:4700::10":   true,
+		"2606:4700::1a":   true,
+		"2606:4700::1f":   true,
+		"2606:4700::20":   false,
+		"::808:814":       false,
+		"2606:4700:1::10": false,
+	}
+
+	for ip, denied := range tests {
+		err = tr.checkIP(net.ParseIP(ip))
+		if denied {
+			if err == nil || !strings.Contains(err.Error(), "is denied by range") {
+				t.Fatalf("expected %s to be denied, got %v", ip, err)
+			}
+		} else if err != nil {
+			t.Fatalf("unexpected error checking %s: %s", ip, err.Error())
+		}
+	}
+
+	// The ranges are reported, but not as CIDRs.
+	found := false
+	for _, entry := range tr.EffectiveDeniedRanges() {
+		if entry.CIDR == "8.8.8.5-8.8.8.50" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected the range to be reported")
+	}
+	for _, entry := range tr.EffectiveDeniedCIDRs() {
+		if strings.Contains(entry, "-") {
+			t.Fatalf("unexpected range reported as a CIDR: %s", entry)
+		}
+	}
+
+	// Invalid ranges are rejected.
+	_, err = NewTransport(Options{DenyIPRanges: []string{"8.8.8.50-8.8.8.5"}})
+	if err == nil {
+		t.Fatalf("expected error with an invalid range")
+	}
+}
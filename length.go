@@ -0,0 +1,219 @@
+package remotehttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxSniffedHeader is the most response header bytes a lengthConn will
+// record, before giving up.
+const maxSniffedHeader = 64 << 10
+
+// lengthConn is a net.Conn which records the framing of the HTTP/1.x
+// responses read from it, if StrictContentLength is set.
+//
+// net/http quietly repairs responses with conflicting length headers, and
+// discards any bytes sent beyond the Content-Length, so these can't be
+// seen in the http.Response.  We instead observe the bytes which are read
+// from the connection, after each request is written.  Connections over
+// which TLS is used can't be observed, so are ignored.
+type lengthConn struct {
+	net.Conn
+
+	// Lock for our state.
+	mutex sync.Mutex
+
+	// The header bytes we've read, until the header is complete.
+	head []byte
+
+	// Is the header complete, or have we given up?
+	done bool
+
+	// Did we give up, as this isn't plain HTTP?
+	ignored bool
+
+	// The Content-Length of the response, or -1 if none.
+	length int64
+
+	// The number of body bytes we've read.
+	body int64
+
+	// A problem with the framing of the response, if any.
+	err error
+}
+
+// Write resets our state, as a new request means a new response.
+func (c *lengthConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	if !c.ignored {
+		c.head, c.done, c.length, c.body, c.err = nil, false, -1, 0, nil
+	}
+	c.mutex.Unlock()
+	return c.Conn.Write(p)
+}
+
+// Read reads from the connection, recording what we've read.
+func (c *lengthConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+
+	c.mutex.Lock()
+	c.observe(p[:n])
+	c.mutex.Unlock()
+	return n, err
+}
+
+// observe records the given bytes, read from the connection.
+func (c *lengthConn) observe(b []byte) {
+
+	if c.ignored || len(b) == 0 {
+		return
+	}
+	if c.done {
+		c.body += int64(len(b))
+		return
+	}
+
+	// Not a HTTP response?  Then we're not interested.
+	if len(c.head) == 0 && b[0] != 'H' {
+		c.ignored = true
+		return
+	}
+
+	c.head = append(c.head, b...)
+	for {
+		end := bytes.Index(c.head, []byte("\r\n\r\n"))
+		if end < 0 {
+			if len(c.head) > maxSniffedHeader {
+				c.done, c.head = true, nil
+			}
+			return
+		}
+		header, rest := c.head[:end], c.head[end+4:]
+
+		// Informational responses precede the real one.
+		if bytes.HasPrefix(header, []byte("HTTP/1.1 1")) || bytes.HasPrefix(header, []byte("HTTP/1.0 1")) {
+			c.head = rest
+			continue
+		}
+
+		c.length, c.err = _responseLength(header)
+		c.done, c.head = true, nil
+		c.body = int64(len(rest))
+		return
+	}
+}
+
+// check returns an error if the response we've read was malformed, or
+// longer than its Content-Length, so far as we've seen.
+func (c *lengthConn) check() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	if c.length >= 0 && c.body > c.length {
+		return fmt.Errorf("response is longer than its Content-Length of %d bytes", c.length)
+	}
+	return nil
+}
+
+// _responseLength returns the Content-Length of the given (raw) response
+// header, or -1 if it has none, rejecting conflicting length headers.
+func _responseLength(header []byte) (int64, error) {
+
+	var lengths []string
+	chunked := false
+	for _, line := range strings.Split(string(header), "\r\n")[1:] {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(line[:i])) {
+		case "content-length":
+			lengths = append(lengths, strings.TrimSpace(line[i+1:]))
+		case "transfer-encoding":
+			chunked = true
+		}
+	}
+
+	switch {
+	case len(lengths) > 1:
+		return -1, fmt.Errorf("response has %d Content-Length headers", len(lengths))
+	case len(lengths) == 1 && chunked:
+		return -1, fmt.Errorf("response has both Content-Length and Transfer-Encoding headers")
+	case len(lengths) == 1:
+		n, err := strconv.ParseInt(lengths[0], 10, 64)
+		if err != nil || n < 0 {
+			return -1, fmt.Errorf("response has invalid Content-Length %q", lengths[0])
+		}
+		return n, nil
+	}
+	return -1, nil
+}
+
+// lengthBody is a response body which checks the framing of its response
+// once it has been read.
+type lengthBody struct {
+	io.ReadCloser
+
+	// The connection the response was read from.
+	conn *lengthConn
+
+	// The URL which was fetched, for our errors.
+	url string
+}
+
+// Read reads from the body, failing at its end if the response was
+// malformed.
+func (l *lengthBody) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	if err == io.EOF {
+		if cerr := l.conn.check(); cerr != nil {
+			return n, fmt.Errorf("response from %s denied: %s", l.url, cerr)
+		}
+	}
+	return n, err
+}
+
+// strictRoundTrip makes the given request, rejecting the response if its
+// framing is malformed, see StrictContentLength.
+func (t *SafeTransport) strictRoundTrip(req *http.Request) (*http.Response, error) {
+
+	var mutex sync.Mutex
+	var conn *lengthConn
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mutex.Lock()
+			conn, _ = info.Conn.(*lengthConn)
+			mutex.Unlock()
+		},
+	})
+
+	resp, err := t.Transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if conn == nil {
+		return resp, nil
+	}
+
+	// Conflicting headers are known immediately, and any excess once
+	// the body has been read.
+	if err := conn.check(); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("response from %s denied: %s", req.URL.Redacted(), err)
+	}
+	resp.Body = &lengthBody{ReadCloser: resp.Body, conn: conn, url: req.URL.Redacted()}
+	return resp, nil
+}
@@ -0,0 +1,62 @@
+package remotehttp
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that responses with malformed lengths may be rejected.
+func TestStrictContentLength(t *testing.T) {
+
+	tests := []struct {
+		response string
+		expected string
+	}{
+		{"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", ""},
+		{"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", ""},
+		{"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", ""},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello world", "is longer than its Content-Length of 5 bytes"},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello", "has 2 Content-Length headers"},
+		{"HTTP/1.1 200 OK\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", "has both Content-Length and Transfer-Encoding headers"},
+	}
+
+	for _, strict := range []bool{true, false} {
+		for _, test := range tests {
+
+			l, port := rawServer(t, test.response)
+
+			tr, err := NewTransport(Options{
+				AllowCIDRs:          []string{"127.0.0.1/32"},
+				StrictContentLength: strict,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error creating transport: %s", err.Error())
+			}
+			client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+			body := ""
+			resp, err := client.Get("http://127.0.0.1:" + port + "/")
+			if err == nil {
+				var out []byte
+				out, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				body = string(out)
+			}
+			l.Close()
+
+			// Without our check net/http repairs the response.
+			if !strict || test.expected == "" {
+				if err != nil || body != "hello" {
+					t.Fatalf("unexpected body %q, error %v, for %q", body, err, test.response)
+				}
+				continue
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Fatalf("expected error %q for %q, got %v", test.expected, test.response, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package remotehttp
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that the default options are used by Transport and Client.
+func TestSetDefaultOptions(t *testing.T) {
+
+	// Reset our defaults once we're done.
+	defer SetDefaultOptions(DefaultOptions())
+
+	err := SetDefaultOptions(Options{DenyHostPatterns: []string{"example.com"}})
+	if err != nil {
+		t.Fatalf("unexpected error setting defaults: %s", err.Error())
+	}
+
+	_, err = Transport().DialContext(context.Background(), "tcp", "example.com:80")
+	if err == nil {
+		t.Fatalf("expected error dialing a denied host")
+	}
+	if !strings.Contains(err.Error(), "denied by pattern") {
+		t.Fatalf("Received an error, but not the expected one.  Got: %s", err.Error())
+	}
+
+	_, err = Client().Get("http://example.com/")
+	if err == nil {
+		t.Fatalf("expected error fetching a denied host")
+	}
+	if !strings.Contains(err.Error(), "denied by pattern") {
+		t.Fatalf("Received an error, but not the expected one.  Got: %s", err.Error())
+	}
+
+	// Invalid options are rejected, and the defaults unchanged.
+	err = SetDefaultOptions(Options{DenyCIDRs: []string{"steve"}})
+	if err == nil {
+		t.Fatalf("expected error setting invalid defaults")
+	}
+	if len(getDefaultOptions().DenyHostPatterns) != 1 {
+		t.Fatalf("defaults were changed by invalid options")
+	}
+}
+
+// Test that an invalid environment allowlist doesn't break our defaults.
+func TestDefaultsInvalidEnvAllowlist(t *testing.T) {
+
+	// Reset our defaults once we're done.
+	defer SetDefaultOptions(DefaultOptions())
+
+	// Don't clutter the test output.
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	t.Setenv("REMOTEHTTP_ALLOW", "10.0.0.0/8")
+	err := SetDefaultOptions(Options{UseEnvAllowlist: true})
+	if err != nil {
+		t.Fatalf("unexpected error setting defaults: %s", err.Error())
+	}
+
+	// The environment changes to something invalid.
+	os.Setenv("REMOTEHTTP_ALLOW", "10.0.0.0/99")
+
+	tr := Transport()
+	if tr == nil {
+		t.Fatalf("expected a transport")
+	}
+	if Client() == nil {
+		t.Fatalf("expected a client")
+	}
+
+	// The allowlist is ignored, so the range is denied.
+	_, err = tr.DialContext(context.Background(), "tcp", "10.1.2.3:80")
+	if err == nil || !strings.Contains(err.Error(), "denied as local") {
+		t.Fatalf("expected the environment allowlist to be ignored, got %v", err)
+	}
+}
+
+// Test that the default transport checks the targets of proxied requests.
+func TestDefaultTransportProxy(t *testing.T) {
+
+	// Reset our defaults once we're done.
+	defer SetDefaultOptions(DefaultOptions())
+
+	// A proxy which answers every request itself.
+	proxied := 0
+	proxy, port := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:" + port)
+	err := SetDefaultOptions(Options{Proxy: proxyURL, AllowHostPorts: []string{"127.0.0.1:" + port}})
+	if err != nil {
+		t.Fatalf("unexpected error setting defaults: %s", err.Error())
+	}
+
+	client := &http.Client{Transport: Transport(), Timeout: 5 * time.Second}
+	_, err = client.Get("http://127.0.0.1/")
+	if err == nil || !strings.Contains(err.Error(), "denied as local") {
+		t.Fatalf("expected a loopback target to be refused, got %v", err)
+	}
+	if proxied != 0 {
+		t.Fatalf("expected nothing to be proxied, got %d requests", proxied)
+	}
+}
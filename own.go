@@ -0,0 +1,89 @@
+package remotehttp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// interfaceAddrs returns the addresses of our local interfaces.
+//
+// This is a variable so that it may be replaced when testing.
+var interfaceAddrs = net.InterfaceAddrs
+
+// ownAddresses holds the addresses of our local interfaces, which are
+// refreshed periodically.
+type ownAddresses struct {
+
+	// The interval at which we refresh our addresses.
+	refresh time.Duration
+
+	// Lock for our state.
+	mutex sync.Mutex
+
+	// The time at which we last read our addresses.
+	updated time.Time
+
+	// The addresses we read.
+	ips []net.IP
+}
+
+// newOwnAddresses reads the addresses of our local interfaces, returning
+// an error if that fails.
+func newOwnAddresses(refresh time.Duration) (*ownAddresses, error) {
+
+	o := &ownAddresses{refresh: refresh}
+
+	ips, err := o.read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read interface addresses: %s", err)
+	}
+	o.ips = ips
+	o.updated = clock()
+
+	return o, nil
+}
+
+// read returns the addresses of our local interfaces.
+func (o *ownAddresses) read() ([]net.IP, error) {
+
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ips = append(ips, v.IP)
+		case *net.IPAddr:
+			ips = append(ips, v.IP)
+		}
+	}
+	return ips, nil
+}
+
+// Contains returns true if the given IP address is one of our own,
+// refreshing our addresses first if they're stale.
+//
+// If a refresh fails then the addresses we read previously are used.
+func (o *ownAddresses) Contains(ip net.IP) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if clock().Sub(o.updated) >= o.refresh {
+		if ips, err := o.read(); err == nil {
+			o.ips = ips
+		}
+		o.updated = clock()
+	}
+
+	for _, entry := range o.ips {
+		if entry.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package remotehttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeInterfaceAddrs replaces our interface-address provider with one
+// returning the given addresses, returning a function to restore it.
+func fakeInterfaceAddrs(addrs *[]string) func() {
+
+	orig := interfaceAddrs
+	interfaceAddrs = func() ([]net.Addr, error) {
+		var out []net.Addr
+		for _, entry := range *addrs {
+			if entry == "error" {
+				return nil, fmt.Errorf("failed to read interfaces")
+			}
+			_, block, _ := net.ParseCIDR(entry)
+			ip, _, _ := net.ParseCIDR(entry)
+			out = append(out, &net.IPNet{IP: ip, Mask: block.Mask})
+		}
+		return out, nil
+	}
+	return func() { interfaceAddrs = orig }
+}
+
+// Test that our own addresses may be denied.
+func TestDenyOwnAddresses(t *testing.T) {
+
+	addrs := []string{"1.2.3.4/24", "2001:db8::1/64"}
+	defer fakeInterfaceAddrs(&addrs)()
+
+	f, restore := useFakeClock()
+	defer restore()
+
+	opts := DefaultOptions()
+	opts.DenyOwnAddresses = true
+	opts.OwnAddressRefresh = time.Minute
+	opts.AllowCIDRs = []string{"1.2.3.0/24"}
+	opts.Resolver = newFakeResolver(map[string][]string{})
+
+	tr, err := NewTransport(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	type TestCase struct {
+		ip     string
+		denied bool
+	}
+
+	tests := []TestCase{
+		{"1.2.3.4", true},
+		{"2001:db8::1", true},
+		{"1.2.3.5", false},
+		{"8.8.8.8", false},
+	}
+
+	for _, test := range tests {
+		_, err := _validate(context.Background(), tr, test.ip, "80")
+		if test.denied {
+			if err == nil || !strings.Contains(err.Error(), "belongs to this host") {
+				t.Fatalf("expected %s to be denied, got %v", test.ip, err)
+			}
+		} else if err != nil {
+			t.Fatalf("unexpected error for %s: %s", test.ip, err.Error())
+		}
+	}
+
+	// Once our addresses change they're refreshed.
+	addrs = []string{"1.2.3.5/24"}
+	f.Advance(time.Minute)
+
+	if _, err := _validate(context.Background(), tr, "1.2.3.4", "80"); err != nil {
+		t.Fatalf("unexpected error after refresh: %s", err.Error())
+	}
+	if _, err := _validate(context.Background(), tr, "1.2.3.5", "80"); err == nil {
+		t.Fatalf("expected the new address to be denied after refresh")
+	}
+
+	// A failed refresh keeps the previous addresses.
+	addrs = []string{"error"}
+	f.Advance(time.Minute)
+
+	if _, err := _validate(context.Background(), tr, "1.2.3.5", "80"); err == nil {
+		t.Fatalf("expected the address to be denied after a failed refresh")
+	}
+
+	// Failing to read the addresses at startup is an error.
+	_, err = NewTransport(opts)
+	if err == nil {
+		t.Fatalf("expected an error creating the transport")
+	}
+
+	// Without the option our addresses are permitted.
+	addrs = []string{"1.2.3.4/24"}
+	opts.DenyOwnAddresses = false
+	tr, err = NewTransport(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	if _, err := _validate(context.Background(), tr, "1.2.3.4", "80"); err != nil {
+		t.Fatalf("unexpected error without the option: %s", err.Error())
+	}
+}
+
+// Test that our own addresses are denied, even for allowed hosts.
+func TestDenyOwnAddressesAllowHosts(t *testing.T) {
+
+	addrs := []string{"1.2.3.4/24"}
+	defer fakeInterfaceAddrs(&addrs)()
+
+	opts := DefaultOptions()
+	opts.DenyOwnAddresses = true
+	opts.AllowHosts = []string{"self.example", "other.example"}
+	opts.Resolver = newFakeResolver(map[string][]string{
+		"self.example":  {"1.2.3.4"},
+		"other.example": {"1.2.3.5"},
+	})
+
+	tr, err := NewTransport(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	_, err = _validate(context.Background(), tr, "self.example", "80")
+	if err == nil || !strings.Contains(err.Error(), "belongs to this host") {
+		t.Fatalf("expected our own address to be denied, got %v", err)
+	}
+	if _, err = _validate(context.Background(), tr, "other.example", "80"); err != nil {
+		t.Fatalf("unexpected error for an allowed host: %s", err.Error())
+	}
+}
@@ -0,0 +1,52 @@
+package remotehttp
+
+import (
+	"context"
+	"net"
+)
+
+// Policy is the interface which may be implemented to decide whether a
+// connection should be permitted.
+//
+// Allow is called for each address a host resolves to, along with the
+// (normalized) hostname and port, and returns an error to deny the
+// connection.  This allows arbitrary logic, such as per-tenant rules, to
+// be applied.
+type Policy interface {
+	Allow(ctx context.Context, host string, ip net.IP, port int) error
+}
+
+// PolicyFunc is an adapter to allow the use of ordinary functions as a
+// Policy.
+type PolicyFunc func(ctx context.Context, host string, ip net.IP, port int) error
+
+// Allow calls f(ctx, host, ip, port).
+func (f PolicyFunc) Allow(ctx context.Context, host string, ip net.IP, port int) error {
+	return f(ctx, host, ip, port)
+}
+
+// AndPolicy is a Policy which permits a connection only if all of its
+// policies permit it.
+//
+// The policies are consulted in order, and the first error is returned.
+type AndPolicy []Policy
+
+// Allow calls each of the policies in turn.
+func (a AndPolicy) Allow(ctx context.Context, host string, ip net.IP, port int) error {
+	for _, p := range a {
+		if err := p.Allow(ctx, host, ip, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultPolicy is a Policy which denies connections to the built-in
+// local network ranges.
+//
+// This is the check which our transport always makes, unless configured
+// otherwise via Options, and is provided so that it may be composed with
+// other policies.
+var DefaultPolicy Policy = PolicyFunc(func(ctx context.Context, host string, ip net.IP, port int) error {
+	return _isLocalIP(ip)
+})
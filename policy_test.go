@@ -0,0 +1,158 @@
+package remotehttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that a custom policy is consulted.
+func TestPolicy(t *testing.T) {
+
+	var calls []string
+	policy := PolicyFunc(func(ctx context.Context, host string, ip net.IP, port int) error {
+		calls = append(calls, fmt.Sprintf("%s %s %d", host, ip, port))
+		if port == 8080 {
+			return fmt.Errorf("port %d denied by policy", port)
+		}
+		return nil
+	})
+
+	tr, err := NewTransport(Options{
+		Policy: policy,
+		Resolver: newFakeResolver(map[string][]string{
+			"public.example": {"1.1.1.1"},
+			"local.example":  {"127.0.0.1"},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	if err = tr.IsSafeURL(context.Background(), "http://public.example:80/"); err != nil {
+		t.Fatalf("unexpected error validating URL: %s", err.Error())
+	}
+	err = tr.IsSafeURL(context.Background(), "http://public.example:8080/")
+	if err == nil || !strings.Contains(err.Error(), "denied by policy") {
+		t.Fatalf("expected error from our policy, got %v", err)
+	}
+
+	// The built-in checks still apply, and happen first.
+	err = tr.IsSafeURL(context.Background(), "http://local.example:80/")
+	if err == nil || !strings.Contains(err.Error(), "denied as local") {
+		t.Fatalf("expected error from the built-in checks, got %v", err)
+	}
+
+	expected := "public.example 1.1.1.1 80,public.example 1.1.1.1 8080"
+	if strings.Join(calls, ",") != expected {
+		t.Fatalf("unexpected calls to our policy: %v", calls)
+	}
+}
+
+// Test composing policies.
+func TestAndPolicy(t *testing.T) {
+
+	var calls []string
+	deny := func(name string, ip string) Policy {
+		return PolicyFunc(func(ctx context.Context, host string, addr net.IP, port int) error {
+			calls = append(calls, name)
+			if addr.String() == ip {
+				return fmt.Errorf("%s denied by %s", addr, name)
+			}
+			return nil
+		})
+	}
+
+	policy := AndPolicy{DefaultPolicy, deny("first", "1.1.1.1"), deny("second", "1.1.1.2")}
+
+	tests := map[string]string{
+		"127.0.0.1": "denied as local",
+		"1.1.1.1":   "denied by first",
+		"1.1.1.2":   "denied by second",
+		"1.1.1.3":   "",
+	}
+
+	for ip, expected := range tests {
+		err := policy.Allow(context.Background(), "example.com", net.ParseIP(ip), 80)
+		if expected == "" {
+			if err != nil {
+				t.Fatalf("unexpected error for %s: %s", ip, err.Error())
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected error '%s' for %s, got %v", expected, ip, err)
+		}
+	}
+
+	// The first policy to deny stops the evaluation.
+	calls = nil
+	policy.Allow(context.Background(), "example.com", net.ParseIP("1.1.1.1"), 80)
+	if strings.Join(calls, ",") != "first" {
+		t.Fatalf("unexpected calls: %v", calls)
+	}
+}
+
+// Test that policies may be selected for each request.
+func TestNamedPolicies(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	deny := func(name string) Policy {
+		return PolicyFunc(func(ctx context.Context, host string, ip net.IP, port int) error {
+			return fmt.Errorf("denied by %s", name)
+		})
+	}
+	allow := PolicyFunc(func(ctx context.Context, host string, ip net.IP, port int) error {
+		return nil
+	})
+
+	tr, err := NewTransport(Options{
+		AllowCIDRs: []string{"127.0.0.1/32"},
+		Resolver:   newFakeResolver(map[string][]string{"shared.example": {"127.0.0.1"}}),
+		Policy:     deny("default"),
+		NamedPolicies: map[string]Policy{
+			"tenant-a": allow,
+			"tenant-b": deny("tenant-b"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	fetch := func(ctx context.Context) error {
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://shared.example:"+port+"/", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.ReadAll(resp.Body)
+		return resp.Body.Close()
+	}
+
+	// The first tenant may fetch the host, leaving an idle connection.
+	if err = fetch(WithPolicyName(context.Background(), "tenant-a")); err != nil {
+		t.Fatalf("unexpected error for tenant-a: %s", err.Error())
+	}
+
+	// But the second may not, despite that connection.
+	err = fetch(WithPolicyName(context.Background(), "tenant-b"))
+	if err == nil || !strings.Contains(err.Error(), "denied by tenant-b") {
+		t.Fatalf("expected tenant-b to be denied, got %v", err)
+	}
+
+	// Unknown tenants use the default policy.
+	for _, ctx := range []context.Context{context.Background(), WithPolicyName(context.Background(), "tenant-c")} {
+		err = fetch(ctx)
+		if err == nil || !strings.Contains(err.Error(), "denied by default") {
+			t.Fatalf("expected the default policy to be used, got %v", err)
+		}
+	}
+}
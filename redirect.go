@@ -0,0 +1,73 @@
+package remotehttp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SafeCheckRedirect is a function suitable for use as the CheckRedirect
+// function of a http.Client, using the options set via SetDefaultOptions.
+//
+// See SafeTransport.CheckRedirect for details.
+func SafeCheckRedirect(req *http.Request, via []*http.Request) error {
+	return getDefaultTransport().CheckRedirect(req, via)
+}
+
+// CheckRedirect is a function suitable for use as the CheckRedirect
+// function of a http.Client.
+//
+// Like the default policy it stops after 10 redirects, and each redirect
+// target is validated before it is followed.  Redirects to schemes which
+// aren't in our AllowedSchemes, such as file://, are rejected.  If the
+// target cannot be resolved the redirect is rejected, unless
+// FailOpenOnResolveError is set in which case it is followed (and will
+// fail when connecting).
+//
+// If SameOriginRedirectsOnly is set redirects to any other scheme, host,
+// or port, than that of the original request are also rejected.
+func (t *SafeTransport) CheckRedirect(req *http.Request, via []*http.Request) error {
+
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	// Is the scheme permitted?
+	if t.checkScheme(req.URL) != nil {
+		return fmt.Errorf("redirect to %s denied: scheme %s is not permitted", req.URL.Redacted(), req.URL.Scheme)
+	}
+
+	// Is the target of the same origin as the original request?
+	if t.options.SameOriginRedirectsOnly && len(via) > 0 {
+		if t.origin(req.URL) != t.origin(via[0].URL) {
+			return fmt.Errorf("redirect to %s denied: not the same origin as %s", req.URL.Redacted(), via[0].URL.Redacted())
+		}
+	}
+
+	_, err := _validate(req.Context(), t, req.URL.Hostname(), t.urlPort(req.URL))
+	if err != nil {
+
+		// Resolution failures are denied, unless we're
+		// failing open.
+		var re *resolveError
+		if errors.As(err, &re) && t.options.FailOpenOnResolveError {
+			return nil
+		}
+		return fmt.Errorf("redirect to %s denied: %s", req.URL.Redacted(), err)
+	}
+	return nil
+}
+
+// origin returns the origin of the given URL, its scheme, host, and port,
+// in a form which may be compared.
+func (t *SafeTransport) origin(u *url.URL) string {
+
+	host, err := _normalizeHost(u.Hostname())
+	if err != nil {
+		host = strings.ToLower(u.Hostname())
+	}
+	return strings.ToLower(u.Scheme) + "://" + net.JoinHostPort(host, t.urlPort(u))
+}
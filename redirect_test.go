@@ -0,0 +1,200 @@
+package remotehttp
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// redirectHandler returns a HTTP handler which redirects to the given URL.
+func redirectHandler(target string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+}
+
+// Test that redirects are validated.
+func TestCheckRedirect(t *testing.T) {
+
+	mux := http.NewServeMux()
+	srv, port := testServer(t, mux)
+	defer srv.Close()
+
+	mux.Handle("/ok", okHandler)
+	mux.Handle("/local", redirectHandler("http://127.0.0.2:"+port+"/ok"))
+	mux.Handle("/unresolvable", redirectHandler("http://unresolvable.example:"+port+"/ok"))
+	mux.Handle("/allowed", redirectHandler("http://127.0.0.1:"+port+"/ok"))
+
+	for _, closed := range []bool{true, false} {
+
+		tr, err := NewTransport(Options{
+			AllowCIDRs:             []string{"127.0.0.1/32"},
+			Resolver:               newFakeResolver(nil),
+			FailOpenOnResolveError: !closed,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+		client := &http.Client{
+			Transport:     tr,
+			CheckRedirect: tr.CheckRedirect,
+			Timeout:       5 * time.Second,
+		}
+
+		// An allowed redirect.
+		resp, err := client.Get(srv.URL + "/allowed")
+		if err != nil {
+			t.Fatalf("unexpected error following redirect: %s", err.Error())
+		}
+		resp.Body.Close()
+
+		// A local redirect is always denied.
+		_, err = client.Get(srv.URL + "/local")
+		if err == nil {
+			t.Fatalf("expected error following a local redirect")
+		}
+		if !strings.Contains(err.Error(), "redirect to http://127.0.0.2:"+port+"/ok denied") {
+			t.Fatalf("Received an error, but not the expected one.  Got: %s", err.Error())
+		}
+
+		// An unresolvable redirect is only denied if we're failing
+		// closed, otherwise our attempt to connect fails.
+		_, err = client.Get(srv.URL + "/unresolvable")
+		if err == nil {
+			t.Fatalf("expected error following an unresolvable redirect")
+		}
+		denied := strings.Contains(err.Error(), "denied")
+		if closed != denied {
+			t.Fatalf("unexpected error following an unresolvable redirect: %s", err.Error())
+		}
+	}
+}
+
+// Test that the default options fail closed.
+func TestCheckRedirectDefault(t *testing.T) {
+
+	if DefaultOptions().FailOpenOnResolveError || (Options{}).FailOpenOnResolveError {
+		t.Fatalf("expected the default options to fail closed")
+	}
+
+	req, err := http.NewRequest("GET", "http://localhost/", nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %s", err.Error())
+	}
+	if SafeCheckRedirect(req, nil) == nil {
+		t.Fatalf("expected error checking a local redirect")
+	}
+	if SafeCheckRedirect(req, make([]*http.Request, 10)) == nil {
+		t.Fatalf("expected error after too many redirects")
+	}
+}
+
+// Test that redirects to other schemes are denied.
+func TestCheckRedirectScheme(t *testing.T) {
+
+	mux := http.NewServeMux()
+	srv, _ := testServer(t, mux)
+	defer srv.Close()
+
+	mux.Handle("/file", redirectHandler("file:///etc/passwd"))
+	mux.Handle("/gopher", redirectHandler("gopher://internal/"))
+
+	tr, err := NewTransport(Options{AllowCIDRs: []string{"127.0.0.1/32"}})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client := &http.Client{
+		Transport:     tr,
+		CheckRedirect: tr.CheckRedirect,
+		Timeout:       5 * time.Second,
+	}
+
+	tests := map[string]string{
+		"/file":   "redirect to file:///etc/passwd denied: scheme file is not permitted",
+		"/gopher": "redirect to gopher://internal/ denied: scheme gopher is not permitted",
+	}
+	for path, expected := range tests {
+		_, err = client.Get(srv.URL + path)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected error %q following %s, got %v", expected, path, err)
+		}
+	}
+}
+
+// Test that redirects may be restricted to the same origin.
+func TestSameOriginRedirectsOnly(t *testing.T) {
+
+	mux := http.NewServeMux()
+	srv, port := testServer(t, mux)
+	defer srv.Close()
+
+	other, otherPort := testServer(t, okHandler)
+	defer other.Close()
+
+	mux.Handle("/ok", okHandler)
+	mux.Handle("/path", redirectHandler("/ok"))
+	mux.Handle("/absolute", redirectHandler("http://127.0.0.1:"+port+"/ok"))
+	mux.Handle("/host", redirectHandler("http://other.example:"+port+"/ok"))
+	mux.Handle("/port", redirectHandler("http://127.0.0.1:"+otherPort+"/ok"))
+	mux.Handle("/scheme", redirectHandler("https://127.0.0.1:"+port+"/ok"))
+
+	for _, sameOrigin := range []bool{true, false} {
+
+		tr, err := NewTransport(Options{
+			AllowCIDRs:              []string{"127.0.0.1/32"},
+			Resolver:                newFakeResolver(map[string][]string{"other.example": {"127.0.0.1"}}),
+			SameOriginRedirectsOnly: sameOrigin,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+		client := &http.Client{
+			Transport:     tr,
+			CheckRedirect: tr.CheckRedirect,
+			Timeout:       5 * time.Second,
+		}
+
+		for _, path := range []string{"/path", "/absolute"} {
+			resp, err := client.Get("http://127.0.0.1:" + port + path)
+			if err != nil {
+				t.Fatalf("unexpected error following %s: %s", path, err.Error())
+			}
+			resp.Body.Close()
+		}
+
+		for _, path := range []string{"/host", "/port"} {
+			resp, err := client.Get("http://127.0.0.1:" + port + path)
+			if sameOrigin {
+				if err == nil || !strings.Contains(err.Error(), "not the same origin as http://127.0.0.1:"+port+path) {
+					t.Fatalf("expected cross-origin redirect from %s to be denied, got %v", path, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("unexpected error following %s: %s", path, err.Error())
+			}
+			resp.Body.Close()
+		}
+
+		// Our test server doesn't speak TLS, so this fails either
+		// way, but it should only be denied as cross-origin when
+		// we're restricting redirects.
+		_, err = client.Get("http://127.0.0.1:" + port + "/scheme")
+		if err == nil || strings.Contains(err.Error(), "not the same origin") != sameOrigin {
+			t.Fatalf("unexpected error following a redirect to https: %v", err)
+		}
+	}
+
+	// Default ports and case are ignored.
+	tr, err := NewTransport(Options{})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	a, _ := url.Parse("HTTP://Example.COM/a")
+	b, _ := url.Parse("http://example.com:80/b")
+	if tr.origin(a) != tr.origin(b) {
+		t.Fatalf("expected %s and %s to be the same origin", a, b)
+	}
+}
@@ -12,12 +12,17 @@
 package remotehttp
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
-	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -30,12 +35,10 @@ var (
 
 	// Helper to setup our cache-maps only once.
 	setup sync.Once
-)
 
-// _isLocalIP tests whether the IP address to which we've connected is a local one.
-func _isLocalIP(IP net.IP) error {
-
-	localIP4 := []string{
+	// The IPv4 ranges we consider local.
+	localIP4 = []string{
+		"0.0.0.0/8",          // RFC 1122 Section 3.2.1.3: "This" network
 		"0.0.0.0/32",         // #9
 		"10.0.0.0/8",         // RFC1918
 		"100.64.0.0/10",      // RFC 6598
@@ -45,26 +48,68 @@ func _isLocalIP(IP net.IP) error {
 		"192.0.0.0/24",       // RFC 5736
 		"192.0.2.0/24",       // RFC 5737
 		"192.168.0.0/16",     // RFC1918
-		"192.18.0.0/15",      // RFC 2544
 		"192.88.99.0/24",     // RFC 3068
-		"198.51.100.0/24",    //
-		"203.0.113.0/24",     //
+		"198.18.0.0/15",      // RFC 2544
+		"198.51.100.0/24",    // RFC 5737
+		"203.0.113.0/24",     // RFC 5737
 		"224.0.0.0/4",        // RFC 3171
+		"240.0.0.0/4",        // RFC 1112 Section 4: Reserved
 		"255.255.255.255/32", // RFC 919 Section 7
 	}
-	localIP6 := []string{
+
+	// The IPv6 ranges we consider local.
+	localIP6 = []string{
 		"::/128",        // RFC 4291: Unspecified Address
 		"100::/64",      // RFC 6666: Discard Address Block
 		"2001:2::/48",   // RFC 5180: Benchmarking
 		"2001::/23",     // RFC 2928: IETF Protocol Assignments
 		"2001::/32",     // RFC 4380: TEREDO
 		"2001:db8::/32", // RFC 3849: Documentation
+		"2002::/16",     // RFC 3056: 6to4
+		"64:ff9b::/96",  // RFC 6052: NAT64
 		"::1/128",       // RFC 4291: Loopback Address
 		"fc00::/7",      // RFC 4193: Unique-Local
 		"fe80::/10",     // RFC 4291: Section 2.5.6 Link-Scoped Unicast
 		"ff00::/8",      // RFC 4291: Section 2.7
 	}
 
+	// The details of each of our local ranges, used to explain our denials.
+	localDetails = map[string]rangeDetail{
+		"0.0.0.0/8":          {category: "this network", reason: "\"this\" network, which some stacks route to this host (RFC 1122)"},
+		"0.0.0.0/32":         {category: "unspecified", reason: "the unspecified address, which may reach this host"},
+		"10.0.0.0/8":         {category: "private", reason: "private network (RFC 1918)"},
+		"100.64.0.0/10":      {category: "shared address space", reason: "shared address space for carrier-grade NAT (RFC 6598)"},
+		"127.0.0.0/8":        {category: "loopback", reason: "loopback addresses, which reach this host (RFC 1122)"},
+		"169.254.0.0/16":     {category: "link-local", reason: "link-local addresses, including cloud metadata endpoints (RFC 3927)"},
+		"172.16.0.0/12":      {category: "private", reason: "private network (RFC 1918)"},
+		"192.0.0.0/24":       {category: "IETF protocol assignment", reason: "IETF protocol assignments (RFC 5736)"},
+		"192.0.2.0/24":       {category: "documentation", reason: "documentation, TEST-NET-1 (RFC 5737)"},
+		"192.168.0.0/16":     {category: "private", reason: "private network (RFC 1918)"},
+		"192.88.99.0/24":     {category: "6to4 relay anycast", reason: "6to4 relay anycast (RFC 3068)"},
+		"198.18.0.0/15":      {category: "benchmarking", reason: "network benchmarking (RFC 2544)"},
+		"198.51.100.0/24":    {category: "documentation", reason: "documentation, TEST-NET-2 (RFC 5737)"},
+		"203.0.113.0/24":     {category: "documentation", reason: "documentation, TEST-NET-3 (RFC 5737)"},
+		"224.0.0.0/4":        {category: "multicast", reason: "multicast (RFC 3171)"},
+		"240.0.0.0/4":        {category: "reserved", reason: "reserved for future use, which some stacks route oddly (RFC 1112)"},
+		"255.255.255.255/32": {category: "broadcast", reason: "limited broadcast (RFC 919)"},
+		"::/128":             {category: "unspecified", reason: "the unspecified address (RFC 4291)"},
+		"100::/64":           {category: "discard", reason: "discard-only address block (RFC 6666)"},
+		"2001:2::/48":        {category: "benchmarking", reason: "network benchmarking (RFC 5180)"},
+		"2001::/23":          {category: "IETF protocol assignment", reason: "IETF protocol assignments (RFC 2928)"},
+		"2001::/32":          {category: "TEREDO", reason: "TEREDO tunnelling, which may reach IPv4 addresses (RFC 4380)"},
+		"2001:db8::/32":      {category: "documentation", reason: "documentation (RFC 3849)"},
+		"2002::/16":          {category: "6to4", reason: "6to4 addresses, which may reach IPv4 addresses (RFC 3056)"},
+		"64:ff9b::/96":       {category: "NAT64", reason: "NAT64 addresses, which may reach IPv4 addresses (RFC 6052)"},
+		"::1/128":            {category: "loopback", reason: "the loopback address, which reaches this host (RFC 4291)"},
+		"fc00::/7":           {category: "unique-local", reason: "unique-local addresses, i.e. private networks (RFC 4193)"},
+		"fe80::/10":          {category: "link-local", reason: "link-local addresses (RFC 4291)"},
+		"ff00::/8":           {category: "multicast", reason: "multicast (RFC 4291)"},
+	}
+)
+
+// _localRanges returns the local network ranges which contain the given IP address, if any.
+func _localRanges(IP net.IP) []string {
+
 	// If we've not already parsed our CIDR ranges into maps then do so.
 	//
 	// This saves time if we're going to test multiple hostnames/URIs
@@ -98,14 +143,117 @@ func _isLocalIP(IP net.IP) error {
 	testMap := ip4Ranges
 
 	// Are we testing an IPv6 address?
-	if strings.Contains(IP.String(), ":") {
+	//
+	// Note that IPv4-mapped IPv6 addresses are treated as IPv4.
+	if IP.To4() == nil {
 		testMap = ip6Ranges
 	}
 
 	// Loop over the appropriate map and test for inclusion
-	for _, block := range testMap {
+	var found []string
+	for entry, block := range testMap {
 		if block.Contains(IP) {
-			return fmt.Errorf("ip address %s is denied as local", IP)
+			found = append(found, entry)
+		}
+	}
+
+	return found
+}
+
+// rangeDetail describes one of our local ranges.
+type rangeDetail struct {
+
+	// A short category, such as "loopback".
+	category string
+
+	// A human-readable reason for denying the range.
+	reason string
+}
+
+// _mostSpecific returns the most specific of the given ranges.
+func _mostSpecific(ranges []string) string {
+
+	best := ""
+	bits := -1
+	for _, entry := range ranges {
+		_, block, err := net.ParseCIDR(entry)
+		if err != nil {
+			continue
+		}
+		if n, _ := block.Mask.Size(); n > bits {
+			best = entry
+			bits = n
+		}
+	}
+	return best
+}
+
+// _localAddressError returns the error for the given IP address, which is
+// within the given local ranges.
+func _localAddressError(IP net.IP, ranges []string) *LocalAddressError {
+
+	entry := _mostSpecific(ranges)
+	return &LocalAddressError{
+		IP:       IP,
+		Range:    entry,
+		Category: localDetails[entry].category,
+		Reason:   localDetails[entry].reason,
+	}
+}
+
+// _embeddedIPv4 returns the IPv4 addresses embedded within the given IPv6
+// address by a transition mechanism, if any.
+//
+// These are the 6to4 gateway, the NAT64 destination, and both the Teredo
+// server and (obfuscated) client.
+func _embeddedIPv4(IP net.IP) []net.IP {
+
+	if IP.To4() != nil || len(IP) != net.IPv6len {
+		return nil
+	}
+
+	switch {
+	case IP[0] == 0x20 && IP[1] == 0x02:
+		return []net.IP{net.IPv4(IP[2], IP[3], IP[4], IP[5])}
+	case IP[:12].Equal(net.IP{0, 0x64, 0xff, 0x9b, 0, 0, 0, 0, 0, 0, 0, 0}):
+		return []net.IP{net.IPv4(IP[12], IP[13], IP[14], IP[15])}
+	case IP[0] == 0x20 && IP[1] == 0x01 && IP[2] == 0 && IP[3] == 0:
+		return []net.IP{
+			net.IPv4(IP[4], IP[5], IP[6], IP[7]),
+			net.IPv4(^IP[12], ^IP[13], ^IP[14], ^IP[15]),
+		}
+	}
+	return nil
+}
+
+// _localError tests whether the given IP address is a local one, ignoring
+// any of the given excluded ranges.
+//
+// IPv4 addresses embedded within an IPv6 address are tested too, so that
+// a local address can't be reached via a transition mechanism even if its
+// range, such as 6to4, has been excluded.
+func _localError(IP net.IP, exclude map[string]bool) error {
+
+	included := func(IP net.IP) []string {
+		var ranges []string
+		for _, entry := range _localRanges(IP) {
+			if !exclude[entry] {
+				ranges = append(ranges, entry)
+			}
+		}
+		return ranges
+	}
+
+	if ranges := included(IP); len(ranges) > 0 {
+		return _localAddressError(IP, ranges)
+	}
+
+	for _, embedded := range _embeddedIPv4(IP) {
+		if ranges := included(embedded); len(ranges) > 0 {
+			err := _localAddressError(embedded, ranges)
+			err.IP = IP
+			err.Embedded = embedded
+			return err
 		}
 	}
 
@@ -113,19 +261,369 @@ func _isLocalIP(IP net.IP) error {
 	return nil
 }
 
+// globalIP6 is the IPv6 space allocated for global unicast, RFC 4291.
+var globalIP6 = &net.IPNet{IP: net.ParseIP("2000::"), Mask: net.CIDRMask(3, 128)}
+
+// nonGlobalIP4 contains the IPv4 ranges which aren't globally routable.
+//
+// These overlap our local ranges, but are checked separately, so that
+// excluding a range from those isn't enough to permit it if we require
+// addresses to be globally routable.
+var nonGlobalIP4 = _parseRanges([]string{
+	"0.0.0.0/8",       // RFC 1122: "This host on this network"
+	"10.0.0.0/8",      // RFC 1918: Private-Use
+	"100.64.0.0/10",   // RFC 6598: Shared Address Space (CGNAT)
+	"127.0.0.0/8",     // RFC 1122: Loopback
+	"169.254.0.0/16",  // RFC 3927: Link Local
+	"172.16.0.0/12",   // RFC 1918: Private-Use
+	"192.0.0.0/24",    // RFC 6890: IETF Protocol Assignments
+	"192.0.2.0/24",    // RFC 5737: Documentation (TEST-NET-1)
+	"192.88.99.0/24",  // RFC 7526: Deprecated 6to4 Relay Anycast
+	"192.168.0.0/16",  // RFC 1918: Private-Use
+	"198.18.0.0/15",   // RFC 2544: Benchmarking
+	"198.51.100.0/24", // RFC 5737: Documentation (TEST-NET-2)
+	"203.0.113.0/24",  // RFC 5737: Documentation (TEST-NET-3)
+	"240.0.0.0/4",     // RFC 1112: Reserved, and Limited Broadcast
+})
+
+// nonGlobalIP6 contains the ranges within globalIP6 which aren't globally
+// routable, checked separately from our local ranges as nonGlobalIP4 is.
+var nonGlobalIP6 = _parseRanges([]string{
+	"2001:2::/48",   // RFC 5180: Benchmarking
+	"2001:db8::/32", // RFC 3849: Documentation
+	"3fff::/20",     // RFC 9637: Documentation
+})
+
+// _parseRanges parses the given (valid) network ranges.
+func _parseRanges(entries []string) []*net.IPNet {
+	var out []*net.IPNet
+	for _, entry := range entries {
+		_, block, err := net.ParseCIDR(entry)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, block)
+	}
+	return out
+}
+
+// _isGlobalUnicast tests whether the given IP address is within the
+// globally-routable unicast space.
+func _isGlobalUnicast(IP net.IP) bool {
+
+	if !IP.IsGlobalUnicast() {
+		return false
+	}
+
+	blocks := nonGlobalIP6
+	if IP.To4() != nil {
+		blocks = nonGlobalIP4
+	} else if !globalIP6.Contains(IP) {
+		return false
+	}
+	for _, block := range blocks {
+		if block.Contains(IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// _isLocalIP tests whether the IP address to which we've connected is a local one.
+func _isLocalIP(IP net.IP) error {
+	return _localError(IP, nil)
+}
+
+// LocalAddressError is returned when a connection to a local address is
+// denied, or to an address denied by the IsDenied predicate of our
+// Options.
+//
+// It implements net.Error, reporting that it is neither a timeout nor
+// temporary, so that retry logic which inspects such errors knows that
+// the request should not be retried.
+type LocalAddressError struct {
+
+	// Host is the host which was rejected, if known.
+	Host string
+
+	// IP is the address which was denied.
+	IP net.IP
+
+	// Embedded is the local IPv4 address embedded within IP, by 6to4,
+	// NAT64, or Teredo, if that's why it was denied.
+	Embedded net.IP
+
+	// Range is the built-in range which contains the address, if it
+	// was denied by one.
+	Range string
+
+	// Category describes the type of local address, such as
+	// "loopback" or "private", or is "custom" if the address was
+	// denied by our IsDenied predicate.
+	Category string
+
+	// Reason explains why the range, or address, is denied.
+	Reason string
+}
+
+// Error returns a description of the denied address, and the host which
+// resolved to it, such as:
+//
+//	host api.example.com rejected: ip address 127.0.0.1 is denied as local (loopback)
+func (l *LocalAddressError) Error() string {
+
+	msg := fmt.Sprintf("ip address %s is denied as local", l.IP)
+	if l.Embedded != nil {
+		msg = fmt.Sprintf("ip address %s is denied as it embeds local address %s", l.IP, l.Embedded)
+	}
+	if l.Range == "" && l.Reason != "" {
+		msg = fmt.Sprintf("ip address %s is denied: %s", l.IP, l.Reason)
+	} else if l.Category != "" {
+		msg += " (" + l.Category + ")"
+	}
+	if l.Host != "" && l.Host != l.IP.String() {
+		msg = fmt.Sprintf("host %s rejected: %s", l.Host, msg)
+	}
+	return msg
+}
+
+// Timeout returns false, as a denial is not a timeout.
+func (l *LocalAddressError) Timeout() bool {
+	return false
+}
+
+// Temporary returns false, as a denial is permanent.
+func (l *LocalAddressError) Temporary() bool {
+	return false
+}
+
+// resolveError is returned when a host cannot be resolved.
+//
+// It allows resolution failures to be distinguished from denials, while
+// still allowing the underlying error to be inspected.
+type resolveError struct {
+	err error
+}
+
+// Error returns the underlying error message.
+func (r *resolveError) Error() string {
+	return r.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (r *resolveError) Unwrap() error {
+	return r.err
+}
+
+// destination describes a host which has been resolved and validated.
+type destination struct {
+
+	// The (normalized) hostname.
+	host string
+
+	// The addresses we may connect to.
+	ips []net.IP
+
+	// Were the addresses pinned, rather than resolved?
+	pinned bool
+}
+
+// _resolve tests whether the given host and port may be connected to,
+// and resolves the host.
+//
+// The addresses which are returned have not been checked, see _validate.
+func _resolve(ctx context.Context, t *SafeTransport, host, port string) (*destination, error) {
+
+	// Is the port denied?  Explicitly allowed combinations of host
+	// and port are permitted regardless.
+	err := t.checkPort(port)
+	if err != nil && !t.allowedHostPort(host, port) {
+		return nil, err
+	}
+
+	// Normalize the host, check it is well-formed, and test it against
+	// our patterns.
+	host, err = _normalizeHost(host)
+	if err != nil {
+		return nil, err
+	}
+	err = _checkHostname(host)
+	if err != nil {
+		return nil, err
+	}
+	err = t.checkHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	// If we only permit our allowlist then the host must be allowed,
+	// unless it might resolve to an allowed range.
+	if t.options.AllowlistOnly && !t.allowedHost(host) && len(t.allow) == 0 && len(t.allowHostPorts) == 0 {
+		return nil, fmt.Errorf("host %s is not allowed", host)
+	}
+
+	// Are IP addresses denied?
+	if t.options.RejectIPHosts && net.ParseIP(host) != nil {
+		return nil, fmt.Errorf("host %s is an IP address, which is denied", host)
+	}
+
+	// If we've an override for this host then use it.
+	var ips []net.IP
+	if ip, ok := t.overrides[host]; ok {
+		ips = []net.IP{ip}
+	}
+
+	// If we've pinned this host then use the address we validated
+	// previously, rather than resolving it again.
+	pinned := false
+	if t.pins != nil && len(ips) == 0 {
+		if ip := t.pins.Get(host); ip != nil {
+			ips = []net.IP{ip}
+			pinned = true
+		}
+	}
+
+	// If we've denied this host recently then do so again, without
+	// resolving it.
+	if t.denials != nil && len(ips) == 0 {
+		if denied := t.denials.Get(t.denyKey(ctx, host, port)); denied != nil {
+			return nil, denied
+		}
+	}
+
+	// If we've resolved this host already, whilst following the
+	// redirects of this request, then re-use its addresses.
+	requestPins := requestPinsFromContext(ctx)
+	if requestPins != nil && len(ips) == 0 {
+		ips = requestPins.get(host)
+	}
+
+	// Resolve the given host to an IP
+	if len(ips) == 0 {
+		ips, err = t.lookupIP(ctx, host)
+		if err != nil {
+
+			// Answers which failed DNSSEC validation are
+			// denials, rather than failures.
+			var dnssec *DNSSECError
+			if errors.As(err, &dnssec) {
+				return nil, dnssec
+			}
+			return nil, &resolveError{err: err}
+		}
+
+		// Report the full set of addresses, before any are
+		// checked or removed.
+		if t.options.OnResolve != nil {
+			t.options.OnResolve(host, append([]net.IP(nil), ips...))
+		}
+		if requestPins != nil {
+			requestPins.set(host, ips)
+		}
+	}
+
+	// Remove any malformed addresses, or fail if we're strict.
+	var valid []net.IP
+	for _, ip := range ips {
+		if len(ip) == net.IPv4len || len(ip) == net.IPv6len {
+			valid = append(valid, ip)
+			continue
+		}
+		if t.options.RequireAllAddressesResolvable {
+			return nil, &resolveError{err: fmt.Errorf("malformed address resolved for %s", host)}
+		}
+	}
+	ips = valid
+
+	// Nothing found?
+	if len(ips) < 1 {
+		return nil, &resolveError{err: fmt.Errorf("no addresses resolved for %s", host)}
+	}
+
+	// Remove any addresses of the family we're not using.
+	if t.options.IPv4Only || t.options.IPv6Only {
+		var tmp []net.IP
+		for _, ip := range ips {
+			if (ip.To4() != nil) == t.options.IPv4Only {
+				tmp = append(tmp, ip)
+			}
+		}
+		if len(tmp) < 1 {
+			return nil, fmt.Errorf("all resolved addresses filtered by IP-version policy for %s", host)
+		}
+		ips = tmp
+	}
+
+	return &destination{host: host, ips: ips, pinned: pinned}, nil
+}
+
+// _validate tests whether the given host and port may be connected to.
+//
+// The host is checked, then resolved, and the resulting addresses are
+// checked too.  If successful the addresses which may be connected to
+// are returned.
+func _validate(ctx context.Context, t *SafeTransport, host, port string) (*destination, error) {
+
+	dest, err := _resolve(ctx, t, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	// Now check the resolved IPs against our blacklist.
+	//
+	// If any of them are denied we reject the host entirely, as one
+	// local address amongst public ones is a sign of a DNS rebinding
+	// attack, or a split-horizon trap.  Unless we're configured to
+	// simply skip the denied addresses.
+	var permitted []net.IP
+	for _, ip := range dest.ips {
+
+		// Then abort, unless we're skipping it.
+		err = t.checkAddress(ctx, dest.host, ip, port)
+		if err != nil {
+			if !t.options.BestEffortResolution {
+				break
+			}
+			continue
+		}
+		permitted = append(permitted, ip)
+	}
+
+	// If we aborted, or all the addresses were skipped, then return
+	// the last error - remembering the host if it was local.
+	if len(permitted) < 1 || (err != nil && !t.options.BestEffortResolution) {
+		var local *LocalAddressError
+		if t.denials != nil && !dest.pinned && errors.As(err, &local) {
+			t.denials.Set(t.denyKey(ctx, dest.host, port), local)
+		}
+		return nil, err
+	}
+
+	dest.ips = permitted
+	return dest, nil
+}
+
 // _checker is the thing that makes our check.
 //
 // This function handles things as you would expect:
 //
 // * Resolve the target to an IP
 //
-// * If the IP is blacklisted abort
+// * If any IP is blacklisted abort
 //
 // * Otherwise update the destination to which we'll connect, such
 //   that we use the returned IP address explicitly.  This ensures we don't
 //   have a time-of-check-time-of-use-race
 //
-func _checker(ctx context.Context, dialler *net.Dialer, network, addr string) (net.Conn, error) {
+func _checker(ctx context.Context, t *SafeTransport, network, addr string) (net.Conn, error) {
+
+	// Record when we started, for our connection information.
+	start := time.Now()
+
+	// Are we shutting down?
+	if t.conns.stopped() {
+		return nil, errShuttingDown
+	}
 
 	// Split the address into host/port
 	host, port, err := net.SplitHostPort(addr)
@@ -133,29 +631,281 @@ func _checker(ctx context.Context, dialler *net.Dialer, network, addr string) (n
 		return nil, err
 	}
 
-	// Resolve the given host to an IP
-	ips, err := net.LookupIP(host)
+	// Resolve and validate the host.
+	//
+	// If we're resolving lazily we check each address only before we
+	// connect to it, below.
+	var dest *destination
+	if t.options.LazyResolution {
+		dest, err = _resolve(ctx, t, host, port)
+	} else {
+		dest, err = _validate(ctx, t, host, port)
+	}
 	if err != nil {
+		t.reportBlock(ctx, host, port, network, err)
 		return nil, err
 	}
 
-	// Now check the resolved IP against our blacklist
-	//
-	// We'll want to rewrite the target so that we
-	// explicitly connect to this resolved IP too,
-	// rather than using the DNS name - which would
-	// be racy.
-	target := ""
+	// Wait for our limiters, if we've got them.
+	limiter := connLimiterFromContext(ctx)
+	if limiter != nil {
+		err = limiter.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.totalConns != nil {
+		err = t.totalConns.acquire(ctx)
+		if err != nil {
+			if limiter != nil {
+				limiter.release()
+			}
+			return nil, err
+		}
+	}
 
-	// For each IP we received
-	for _, ip := range ips {
+	// Order our addresses, split them by family if we've a preference,
+	// and connect.
+	primary, fallback := t.dialOrder(dest.ips)
+	var res dialResult
+	if t.options.FamilyFallbackDelay > 0 && len(primary) > 0 && len(fallback) > 0 {
+		res = _dialParallel(ctx, t, dest.host, network, port, primary, fallback)
+	} else {
+		res = _dialAddresses(ctx, t, dest.host, network, port, append(primary, fallback...))
+	}
+
+	if res.con != nil {
+		con := res.con
 
-		// Is it blacklisted?  Then abort
-		err = _isLocalIP(ip)
+		// Pin the host to this address, if we're pinning
+		// and the host wasn't already an IP, or pinned.
+		if t.pins != nil && !dest.pinned && net.ParseIP(dest.host) == nil {
+			t.pins.Set(dest.host, res.ip)
+		}
+
+		// Record the connection details, if requested.
+		n, _ := strconv.Atoi(port)
+		details := ConnInfo{
+			Host:     dest.host,
+			IP:       res.ip,
+			Port:     n,
+			Network:  network,
+			Duration: time.Since(start),
+			Metadata: blockMetadataFromContext(ctx),
+		}
+		if info := connInfoFromContext(ctx); info != nil {
+			*info = details
+		}
+		if t.options.OnConnect != nil {
+			t.options.OnConnect(details)
+		}
+
+		// Release our limiters when the connection is closed.
+		if limiter != nil {
+			con = &limitedConn{Conn: con, limiter: limiter}
+		}
+		if t.totalConns != nil {
+			con = &limitedConn{Conn: con, limiter: t.totalConns}
+		}
+
+		// Throttle the connection, if we should.
+		if t.options.BytesPerSecond > 0 {
+			con = newThrottledConn(con, t.options.BytesPerSecond)
+		}
+
+		// Track the connection, unless we've started shutting
+		// down whilst connecting.
+		con, err = t.conns.track(con)
 		if err != nil {
 			return nil, err
 		}
 
+		// Observe the framing of our responses, if we should.
+		if t.options.StrictContentLength {
+			con = &lengthConn{Conn: con, length: -1}
+		}
+
+		// No error?  Then we're good and we return the
+		// connection to the caller.
+		return con, nil
+	}
+
+	// We've made no connection, so release our limiters.
+	if limiter != nil {
+		limiter.release()
+	}
+	if t.totalConns != nil {
+		t.totalConns.release()
+	}
+
+	// If we resolved lazily, and found a denied address before we
+	// could connect, then report that.
+	if res.denied != nil && (!t.options.BestEffortResolution || res.attempted == 0) {
+		t.reportBlock(ctx, dest.host, port, network, res.denied)
+		return nil, res.denied
+	}
+
+	// If we got here then we resolved the host, but connecting to
+	// any (valid) IP failed.
+	n, _ := strconv.Atoi(port)
+	return nil, &ConnectError{Host: dest.host, IP: res.lastIP, Port: n, Err: res.err}
+}
+
+// ConnectError is returned when a host was resolved, and permitted, but
+// no connection could be made to any of its addresses.
+//
+// As we connect to the addresses a host resolved to, rather than the host
+// itself, the errors from the dialler name only the address.  This error
+// records the host which was requested too.
+type ConnectError struct {
+
+	// Host is the host which was requested.
+	Host string
+
+	// IP is the address we last tried to connect to, if any.
+	IP net.IP
+
+	// Port is the port we tried to connect to.
+	Port int
+
+	// Err is the error from our last attempt to connect, if any.
+	Err error
+}
+
+// Error returns a description of the failure, such as:
+//
+//	failed to connect to api.example.com:443: dial tcp 1.2.3.4:443: connect: connection refused
+func (c *ConnectError) Error() string {
+
+	msg := fmt.Sprintf("failed to connect to %s", net.JoinHostPort(c.Host, strconv.Itoa(c.Port)))
+	if c.Err != nil {
+		msg += ": " + c.Err.Error()
+	} else if c.IP != nil {
+		msg += " via " + c.IP.String()
+	}
+	return msg
+}
+
+// Unwrap returns the error from our last attempt to connect.
+func (c *ConnectError) Unwrap() error {
+	return c.Err
+}
+
+// dialResult holds the outcome of connecting to a list of addresses.
+type dialResult struct {
+
+	// The connection made, if any.
+	con net.Conn
+
+	// The address connected to.
+	ip net.IP
+
+	// The error from the last denied address, if any.
+	denied error
+
+	// The number of addresses we tried to connect to.
+	attempted int
+
+	// The address of, and error from, the last connection attempt,
+	// if any.
+	lastIP net.IP
+	err    error
+}
+
+// dialOrder returns the given addresses in the order in which we'd try
+// them, as configured by IPSelection and PreferredFamily, split into those
+// of the preferred family and the rest.
+func (t *SafeTransport) dialOrder(ips []net.IP) ([]net.IP, []net.IP) {
+	ips = _orderAddresses(ips, t.options.IPSelection)
+	return _splitFamilies(ips, t.options.PreferredFamily)
+}
+
+// _splitFamilies splits the given addresses into those of the preferred
+// family, and the rest.
+//
+// If there is no preference all addresses are returned as preferred.
+func _splitFamilies(ips []net.IP, family IPFamily) ([]net.IP, []net.IP) {
+	if family == AnyFamily {
+		return ips, nil
+	}
+
+	var primary, fallback []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (family == IPv4Family) {
+			primary = append(primary, ip)
+		} else {
+			fallback = append(fallback, ip)
+		}
+	}
+	return primary, fallback
+}
+
+// random is used to randomise the order of addresses, see
+// _orderAddresses, and our retry delays.
+var random = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// _orderAddresses returns the given addresses in the order in which
+// they should be connected to.
+//
+// The addresses given are not modified.
+func _orderAddresses(ips []net.IP, selection IPSelection) []net.IP {
+	if selection == AsReturned || len(ips) < 2 {
+		return ips
+	}
+
+	ordered := make([]net.IP, len(ips))
+	copy(ordered, ips)
+
+	switch selection {
+	case Random:
+		random.Lock()
+		random.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+		random.Unlock()
+	case Stable:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			a, b := ordered[i].To4() != nil, ordered[j].To4() != nil
+			if a != b {
+				return a
+			}
+			return bytes.Compare(ordered[i].To16(), ordered[j].To16()) < 0
+		})
+	}
+	return ordered
+}
+
+// _dialAddresses connects to each of the given addresses in turn, until
+// a connection succeeds.
+//
+// If we're resolving lazily each address is checked before we connect.
+func _dialAddresses(ctx context.Context, t *SafeTransport, host, network, port string, ips []net.IP) dialResult {
+
+	var res dialResult
+	for _, ip := range ips {
+
+		// Check the address, if we've not already.
+		if t.options.LazyResolution {
+			err := t.checkAddress(ctx, host, ip, port)
+			if err != nil {
+				res.denied = err
+				if !t.options.BestEffortResolution {
+					break
+				}
+				continue
+			}
+		}
+		res.attempted++
+
+		// We'll want to rewrite the target so that we
+		// explicitly connect to this resolved IP too,
+		// rather than using the DNS name - which would
+		// be racy.
+		target := ""
+
 		// Set the connection-target to the resolved address.
 		if ip.To4() != nil {
 			target = fmt.Sprintf("%s:%s", ip, port)
@@ -164,70 +914,146 @@ func _checker(ctx context.Context, dialler *net.Dialer, network, addr string) (n
 			target = fmt.Sprintf("[%s]:%s", ip, port)
 		}
 
-		// If the IP was bad we'll have terminated already
-		//
-		// So if we managed to get here we found (at least) 1 valid IP.
-		//
 		// We'll walk over each IP; so if `example.com` resolves
 		// to 1.2.3.4 and 1.2.3.6 we'll try each of them in turn.
 		//
 		// Importantly here we're using `target` to specify the resolved
 		// address we've confirmed is safe.
 		//
-		con, err := dialler.DialContext(ctx, network, target)
+		con, err := t.dialRetry(ctx, network, target)
 		if err == nil {
-			// No error?  Then we're good and we return the
-			// connection to the caller.
-			return con, err
+			res.con = con
+			res.ip = ip
+			return res
 		}
+		res.lastIP = ip
+		res.err = err
 	}
+	return res
+}
 
-	//
-	// If we got here then:
-	//
-	//  a) We didn't resolve the host.
-	//
-	//  b) We resolved the host, but connecting to any (valid) IP
-	//     failed
-	if len(ips) < 1 {
-		return nil, fmt.Errorf("failed to resolve host from %s", addr)
+// _dialParallel connects to the primary addresses, and after our fallback
+// delay - or the primary addresses failing - to the fallback addresses too.
+//
+// The first connection made is returned, and any other is closed.
+func _dialParallel(ctx context.Context, t *SafeTransport, host, network, port string, primary, fallback []net.IP) dialResult {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, 2)
+	dial := func(ips []net.IP) {
+		results <- _dialAddresses(ctx, t, host, network, port, ips)
 	}
 
-	// Failed to connect
-	return nil, fmt.Errorf("failed to connect to %s", addr)
-}
+	// Start with the preferred family.
+	go dial(primary)
+	pending := 1
 
-// Transport returns our wrapped http.Transport object.
-//
-// This function is the sole interface to this library, which is designed to automatically deny connections to
-// "local" resources.
-//
-// You may modify the transport as you wish, once you've received it.  However note that the `DialContext` function should
-// not be changed, or our protection is removed.
-func Transport() *http.Transport {
+	timer := time.NewTimer(t.options.FamilyFallbackDelay)
+	defer timer.Stop()
+
+	var res dialResult
+	fallbackStarted := false
+	for pending > 0 || !fallbackStarted {
+
+		// Start the fallback once our delay has passed.
+		var expired <-chan time.Time
+		if !fallbackStarted {
+			expired = timer.C
+		}
 
-	// Setup a timeout in our dialler; though the user could change this.
-	dialler := &net.Dialer{
-		DualStack: true,
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
+		select {
+		case <-expired:
+			fallbackStarted = true
+			go dial(fallback)
+			pending++
+			continue
+		case r := <-results:
+			pending--
+
+			res.attempted += r.attempted
+			if r.denied != nil {
+				res.denied = r.denied
+			}
+			if r.err != nil {
+				res.lastIP = r.lastIP
+				res.err = r.err
+			}
+
+			// Connected?  Then close any later connection.
+			if r.con != nil {
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.con != nil {
+							late.con.Close()
+						}
+					}
+				}(pending)
+				res.con = r.con
+				res.ip = r.ip
+				return res
+			}
+
+			// A denied address is fatal, unless we're
+			// making a best-effort.
+			if r.denied != nil && !t.options.BestEffortResolution {
+				cancel()
+				for ; pending > 0; pending-- {
+					if late := <-results; late.con != nil {
+						late.con.Close()
+					}
+				}
+				return res
+			}
+
+			// The primary failed, so don't wait to fallback.
+			if !fallbackStarted {
+				fallbackStarted = true
+				go dial(fallback)
+				pending++
+			}
+		}
 	}
+	return res
+}
 
-	// Create a transport with the suitable handlers.
-	return &http.Transport{
+// _isTransient returns true if the given connection error appears to be temporary.
+func _isTransient(err error) bool {
 
-		// Setup the dialler.
-		Dial: dialler.Dial,
+	// Timeouts are worth retrying.
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
 
-		// Setup the connection helper
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return (_checker(ctx, dialler, network, addr))
-		},
+	// As are resets and similar.
+	for _, errno := range []syscall.Errno{syscall.ECONNRESET, syscall.ECONNABORTED, syscall.ECONNREFUSED} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// Transport returns a SafeTransport, created with the options set via
+// SetDefaultOptions.
+//
+// This function is the simplest interface to this library, which is designed to automatically deny connections to
+// "local" resources.  If you wish to customize the behaviour see NewTransport, or SetDefaultOptions.
+//
+// The SafeTransport itself is returned, rather than the http.Transport it wraps, as some options such as Proxy and
+// NamedPolicies are enforced by its RoundTrip.  You may modify the embedded transport as you wish, once you've
+// received it.  However note that the `DialContext` function should not be changed, or our protection is removed.
+func Transport() *SafeTransport {
 
-		// Setup a simple timeout
-		TLSHandshakeTimeout: 5 * time.Second,
+	opts := getDefaultOptions()
+	t, err := NewTransport(opts)
 
-		// Setup a simple timeout
-		ResponseHeaderTimeout: 5 * time.Second,
+	// Without the environment the options are those which
+	// SetDefaultOptions validated.
+	if opts, retry := _withoutEnvAllowlist(opts, err); retry {
+		t, _ = NewTransport(opts)
 	}
+	return t
 }
@@ -36,8 +36,8 @@ func Example() {
 		//
 		// Because we could get two different errors:
 		//
-		//    ip address ::1 is denied as local
-		//    ip address 127.0.0.1 is denied as local
+		//    host localhost rejected: ip address ::1 is denied as local (loopback)
+		//    host localhost rejected: ip address 127.0.0.1 is denied as local (loopback)
 		//
 		// We want to be stable, and work regardless of what the
 		// local testing-system returns.
@@ -49,5 +49,5 @@ func Example() {
 		fmt.Printf("ERROR:%s\n", out)
 	}
 	// Output:
-	// ERROR:Get "http://localhost/server-status": ip address is denied as local
+	// ERROR:Get "http://localhost/server-status": host localhost rejected: ip address is denied as local (loopback)
 }
@@ -1,6 +1,9 @@
 package remotehttp
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
 	"strings"
 	"testing"
@@ -75,3 +78,551 @@ func TestRemoteURLs(t *testing.T) {
 		}
 	}
 }
+
+// Test that IP addresses may be rejected as hosts.
+func TestRejectIPHosts(t *testing.T) {
+
+	tr, err := NewTransport(Options{RejectIPHosts: true})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	var netClient = &http.Client{
+		Transport: tr,
+		Timeout:   5 * time.Second,
+	}
+
+	tests := []string{"http://203.0.113.5/",
+		"http://[2001:db8::1]:8080/",
+	}
+
+	for _, url := range tests {
+
+		_, err = netClient.Get(url)
+		if err == nil {
+			t.Fatalf("Expected error requesting %s - expected to be denied", url)
+		}
+		if !strings.Contains(err.Error(), "is an IP address") {
+			t.Fatalf("Received an error accessing %s, but not the expected one.  Got: %s", url, err.Error())
+		}
+	}
+}
+
+// Test that resolving nothing is distinct from filtering everything.
+func TestNoAddresses(t *testing.T) {
+
+	resolver := newFakeResolver(map[string][]string{
+		"empty.example": {""},
+		"ipv6.example":  {"2606:4700::1,2606:4700::2"},
+		"ipv4.example":  {"1.1.1.1"},
+	})
+
+	tests := []struct {
+		opts Options
+		host string
+		err  string
+	}{
+		{Options{}, "empty.example", "no addresses resolved"},
+		{Options{IPv4Only: true}, "empty.example", "no addresses resolved"},
+		{Options{IPv4Only: true}, "ipv6.example", "all resolved addresses filtered by IP-version policy"},
+		{Options{IPv6Only: true}, "ipv4.example", "all resolved addresses filtered by IP-version policy"},
+	}
+
+	for _, test := range tests {
+
+		test.opts.Resolver = resolver
+		tr, err := NewTransport(test.opts)
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+
+		_, err = tr.DialContext(context.Background(), "tcp", test.host+":80")
+		if err == nil {
+			t.Fatalf("expected error dialing %s", test.host)
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Received an error dialing %s, but not the expected one.  Got: %s", test.host, err.Error())
+		}
+	}
+
+	// Both options together are invalid.
+	_, err := NewTransport(Options{IPv4Only: true, IPv6Only: true})
+	if err == nil {
+		t.Fatalf("expected an error with both IPv4Only and IPv6Only")
+	}
+}
+
+// Test that denied ports are rejected.
+func TestDeniedPorts(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	tr, err := NewTransport(Options{
+		AllowCIDRs:  []string{"127.0.0.1/32"},
+		DeniedPorts: []int{22, 6379},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	var netClient = &http.Client{
+		Transport: tr,
+		Timeout:   5 * time.Second,
+	}
+
+	// A denied port.
+	_, err = netClient.Get("http://127.0.0.1:6379/")
+	if err == nil {
+		t.Fatalf("Expected error requesting a denied port")
+	}
+	if !strings.Contains(err.Error(), "port 6379 is denied") {
+		t.Fatalf("Received an error, but not the expected one.  Got: %s", err.Error())
+	}
+
+	// An allowed one.
+	resp, err := netClient.Get("http://127.0.0.1:" + port + "/")
+	if err != nil {
+		t.Fatalf("Didn't expect error; %s", err.Error())
+	}
+	resp.Body.Close()
+
+	// Invalid ports are rejected.
+	_, err = NewTransport(Options{DeniedPorts: []int{65536}})
+	if err == nil {
+		t.Fatalf("expected error with an invalid port")
+	}
+}
+
+// Test hosts which resolve to both permitted and denied addresses.
+func TestMixedResolution(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	for _, best := range []bool{false, true} {
+
+		tr, err := NewTransport(Options{
+			AllowCIDRs:           []string{"127.0.0.1/32"},
+			BestEffortResolution: best,
+			Resolver: newFakeResolver(map[string][]string{
+				"public-first.example":  {"127.0.0.1,fc00::1"},
+				"private-first.example": {"fc00::1,127.0.0.1"},
+				"private-only.example":  {"fc00::1,fc00::2"},
+			}),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+
+		var netClient = &http.Client{
+			Transport: tr,
+			Timeout:   5 * time.Second,
+		}
+
+		for _, host := range []string{"public-first.example", "private-first.example"} {
+
+			resp, err := netClient.Get("http://" + host + ":" + port + "/")
+			if best {
+				if err != nil {
+					t.Fatalf("Didn't expect error; %s - %s", host, err.Error())
+				}
+				resp.Body.Close()
+				continue
+			}
+
+			if err == nil {
+				t.Fatalf("Expected error requesting %s - expected to be denied", host)
+			}
+			if !strings.Contains(err.Error(), "fc00::1 is denied as local") {
+				t.Fatalf("Received an error accessing %s, but not the expected one.  Got: %s", host, err.Error())
+			}
+		}
+
+		// If there are no permitted addresses we fail regardless.
+		_, err = netClient.Get("http://private-only.example:" + port + "/")
+		if err == nil {
+			t.Fatalf("Expected error requesting private-only.example - expected to be denied")
+		}
+	}
+}
+
+// Test that denials of local addresses are permanent net.Errors.
+func TestLocalAddressError(t *testing.T) {
+
+	var netClient = &http.Client{
+		Transport: Transport(),
+		Timeout:   5 * time.Second,
+	}
+
+	_, err := netClient.Get("http://127.0.0.1/")
+	if err == nil {
+		t.Fatalf("expected an error requesting a local address")
+	}
+
+	var local *LocalAddressError
+	if !errors.As(err, &local) {
+		t.Fatalf("expected a LocalAddressError, got %T: %s", err, err.Error())
+	}
+	if !local.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("unexpected address in error: %s", local.IP)
+	}
+
+	var ne net.Error = local
+	if ne.Timeout() || ne.Temporary() {
+		t.Fatalf("expected the error to be permanent")
+	}
+}
+
+// Test that addresses may be checked lazily, before each is connected to.
+func TestLazyResolution(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	type TestCase struct {
+		lazy bool
+		best bool
+		host string
+		ok   bool
+	}
+
+	tests := []TestCase{
+		{false, false, "public-first.example", false},
+		{false, false, "private-first.example", false},
+		{true, false, "public-first.example", true},
+		{true, false, "private-first.example", false},
+		{true, true, "private-first.example", true},
+		{true, false, "private-only.example", false},
+		{true, true, "private-only.example", false},
+	}
+
+	for _, test := range tests {
+
+		tr, err := NewTransport(Options{
+			AllowCIDRs:           []string{"127.0.0.1/32"},
+			LazyResolution:       test.lazy,
+			BestEffortResolution: test.best,
+			Resolver: newFakeResolver(map[string][]string{
+				"public-first.example":  {"127.0.0.1,fc00::1"},
+				"private-first.example": {"fc00::1,127.0.0.1"},
+				"private-only.example":  {"fc00::1,fc00::2"},
+			}),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+
+		var netClient = &http.Client{
+			Transport: tr,
+			Timeout:   5 * time.Second,
+		}
+
+		resp, err := netClient.Get("http://" + test.host + ":" + port + "/")
+		if test.ok {
+			if err != nil {
+				t.Fatalf("Didn't expect error; %+v - %s", test, err.Error())
+			}
+			resp.Body.Close()
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("Expected error; %+v", test)
+		}
+		if !strings.Contains(err.Error(), "is denied as local") {
+			t.Fatalf("Received an error with %+v, but not the expected one.  Got: %s", test, err.Error())
+		}
+
+		// Validation always checks every address.
+		if test.lazy && !test.best {
+			err = tr.IsSafeURL(context.Background(), "http://public-first.example/")
+			if err == nil {
+				t.Fatalf("expected IsSafeURL to check every address")
+			}
+		}
+	}
+}
+
+// Test that mixed-result denials name the host, and the offending address.
+func TestLocalAddressErrorDetails(t *testing.T) {
+
+	tr, err := NewTransport(Options{
+		Resolver: newFakeResolver(map[string][]string{
+			"api.evil.example":    {"1.1.1.1,127.0.0.1"},
+			"lan.evil.example":    {"1.1.1.1,192.168.1.1"},
+			"teredo.evil.example": {"2001::1"},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	tests := map[string]string{
+		"http://api.evil.example/":    "host api.evil.example rejected: ip address 127.0.0.1 is denied as local (loopback)",
+		"http://lan.evil.example/":    "host lan.evil.example rejected: ip address 192.168.1.1 is denied as local (private)",
+		"http://teredo.evil.example/": "host teredo.evil.example rejected: ip address 2001::1 is denied as local (TEREDO)",
+		"http://10.1.2.3/":            "ip address 10.1.2.3 is denied as local (private)",
+	}
+
+	for u, expected := range tests {
+		err = tr.IsSafeURL(context.Background(), u)
+		if err == nil || err.Error() != expected {
+			t.Fatalf("expected error %q validating %s, got %v", expected, u, err)
+		}
+
+		var local *LocalAddressError
+		if !errors.As(err, &local) {
+			t.Fatalf("expected a LocalAddressError, got %T", err)
+		}
+	}
+}
+
+// Test the edges of the benchmarking range, RFC 2544.
+func TestBenchmarkingRange(t *testing.T) {
+
+	tests := map[string]bool{
+		"198.17.255.255": false,
+		"198.18.0.1":     true,
+		"198.19.255.255": true,
+		"198.20.0.0":     false,
+		"192.18.0.1":     false,
+		"192.19.1.1":     false,
+	}
+
+	for ip, local := range tests {
+		err := _isLocalIP(net.ParseIP(ip))
+		if local && err == nil {
+			t.Fatalf("expected %s to be denied as local", ip)
+		}
+		if !local && err != nil {
+			t.Fatalf("unexpected error for %s: %s", ip, err.Error())
+		}
+	}
+}
+
+// Test that "this" network, and the reserved range, are denied.
+func TestReservedRanges(t *testing.T) {
+
+	tests := map[string]string{
+		"0.1.2.3":         "this network",
+		"0.0.0.0":         "unspecified",
+		"240.0.0.1":       "reserved",
+		"254.1.1.1":       "reserved",
+		"255.255.255.255": "broadcast",
+	}
+
+	for ip, category := range tests {
+		err := _isLocalIP(net.ParseIP(ip))
+		var local *LocalAddressError
+		if !errors.As(err, &local) {
+			t.Fatalf("expected %s to be denied as local, got %v", ip, err)
+		}
+		if local.Category != category {
+			t.Fatalf("expected %s to be denied as %s, got %s", ip, category, local.Category)
+		}
+	}
+
+	for _, ip := range []string{"1.0.0.1", "223.255.255.255"} {
+		if err := _isLocalIP(net.ParseIP(ip)); err != nil {
+			t.Fatalf("unexpected error for %s: %s", ip, err.Error())
+		}
+	}
+}
+
+// Test that IPv4 addresses embedded by transition mechanisms are checked.
+func TestEmbeddedIPv4(t *testing.T) {
+
+	tests := map[string]string{
+		"2002:7f00:1::":                        "127.0.0.1",
+		"64:ff9b::7f00:1":                      "127.0.0.1",
+		"2001:0:4136:e378:8000:63bf:80ff:fffe": "65.54.227.120,127.0.0.1",
+		"2606:4700::1111":                      "",
+		"::ffff:127.0.0.1":                     "",
+	}
+	for ip, expected := range tests {
+		var found []string
+		for _, embedded := range _embeddedIPv4(net.ParseIP(ip)) {
+			found = append(found, embedded.String())
+		}
+		if strings.Join(found, ",") != expected {
+			t.Fatalf("expected %s to embed %q, got %v", ip, expected, found)
+		}
+	}
+
+	// The transition ranges are denied outright.
+	for _, ip := range []string{"2002:7f00:1::", "2002:101:101::", "64:ff9b::101:101"} {
+		if _isLocalIP(net.ParseIP(ip)) == nil {
+			t.Fatalf("expected %s to be denied", ip)
+		}
+	}
+
+	// But their embedded addresses are checked, even if they're
+	// excluded.
+	tr, err := NewTransport(Options{ExcludeCIDRs: []string{"2002::/16", "64:ff9b::/96", "2001::/32", "2001::/23"}})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	denied := map[string]string{
+		"2002:7f00:1::":                        "ip address 2002:7f00:1:: is denied as it embeds local address 127.0.0.1 (loopback)",
+		"64:ff9b::a00:1":                       "ip address 64:ff9b::a00:1 is denied as it embeds local address 10.0.0.1 (private)",
+		"2001:0:4136:e378:8000:63bf:80ff:fffe": "ip address 2001:0:4136:e378:8000:63bf:80ff:fffe is denied as it embeds local address 127.0.0.1 (loopback)",
+	}
+	for ip, expected := range denied {
+		err = tr.checkIP(net.ParseIP(ip))
+		if err == nil || err.Error() != expected {
+			t.Fatalf("expected error %q for %s, got %v", expected, ip, err)
+		}
+		var local *LocalAddressError
+		if !errors.As(err, &local) || local.Embedded == nil || local.IP.String() != ip {
+			t.Fatalf("unexpected error details for %s: %+v", ip, local)
+		}
+	}
+
+	for _, ip := range []string{"2002:101:101::", "64:ff9b::101:101", "2001:0:4136:e378:8000:63bf:fefe:fefe"} {
+		if err = tr.checkIP(net.ParseIP(ip)); err != nil {
+			t.Fatalf("unexpected error for %s: %s", ip, err.Error())
+		}
+	}
+}
+
+// Test that every built-in range explains itself.
+func TestLocalRangeReasons(t *testing.T) {
+
+	for _, entry := range append(localIP4, localIP6...) {
+		detail, ok := localDetails[entry]
+		if !ok || detail.reason == "" || detail.category == "" {
+			t.Fatalf("built-in range %s has no reason", entry)
+		}
+	}
+	if len(localDetails) != len(localIP4)+len(localIP6) {
+		t.Fatalf("unexpected details for ranges which aren't built-in")
+	}
+
+	// The reason is recorded in our errors.
+	var local *LocalAddressError
+	if !errors.As(_isLocalIP(net.ParseIP("203.0.113.7")), &local) {
+		t.Fatalf("expected a LocalAddressError")
+	}
+	if local.Range != "203.0.113.0/24" || local.Reason != "documentation, TEST-NET-3 (RFC 5737)" {
+		t.Fatalf("unexpected range %s and reason %s", local.Range, local.Reason)
+	}
+}
+
+// Test that entire address families may be denied.
+func TestDenyFamilies(t *testing.T) {
+
+	resolver := newFakeResolver(map[string][]string{
+		"dual.example": {"1.1.1.1,2606:4700::1111"},
+		"ipv4.example": {"1.1.1.1"},
+		"ipv6.example": {"2606:4700::1111"},
+	})
+
+	type TestCase struct {
+		opts     Options
+		host     string
+		expected string
+	}
+
+	tests := []TestCase{
+		{Options{DenyIPv6: true}, "dual.example", ""},
+		{Options{DenyIPv6: true}, "ipv4.example", ""},
+		{Options{DenyIPv6: true}, "ipv6.example", "no addresses resolved"},
+		{Options{DenyIPv6: true}, "2606:4700::1111", "IPv6 connections are disabled"},
+		{Options{DenyIPv6: true, AllowHosts: []string{"2606:4700::1111"}}, "2606:4700::1111", "IPv6 connections are disabled"},
+		{Options{DenyIPv4: true}, "dual.example", ""},
+		{Options{DenyIPv4: true}, "ipv4.example", "no addresses resolved"},
+		{Options{DenyIPv4: true}, "1.1.1.1", "IPv4 connections are disabled"},
+		{Options{DenyIPv4: true}, "::ffff:1.1.1.1", "IPv4 connections are disabled"},
+		{Options{DenyIPv4: true}, "ipv6.example", ""},
+	}
+
+	for _, test := range tests {
+		test.opts.Resolver = resolver
+		tr, err := NewTransport(test.opts)
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+
+		dest, err := _validate(context.Background(), tr, test.host, "80")
+		if test.expected == "" {
+			if err != nil {
+				t.Fatalf("unexpected error for %s: %s", test.host, err.Error())
+			}
+			for _, ip := range dest.ips {
+				if (ip.To4() != nil) == test.opts.DenyIPv4 {
+					t.Fatalf("address %s of a denied family was resolved for %s", ip, test.host)
+				}
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("expected error %q for %s, got %v", test.expected, test.host, err)
+		}
+	}
+
+	// The real resolver only looks up the permitted family, but
+	// addresses are still denied, rather than failing to resolve.
+	literals := map[string]Options{
+		"1.1.1.1:80":           {DenyIPv4: true},
+		"[2606:4700::1111]:80": {DenyIPv6: true},
+	}
+	for addr, opts := range literals {
+		blocked := 0
+		opts.Resolver = net.DefaultResolver
+		opts.OnBlock = func(info ConnInfo, err error) { blocked++ }
+		tr, err := NewTransport(opts)
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+		_, err = tr.DialContext(context.Background(), "tcp", addr)
+		if err == nil || !strings.Contains(err.Error(), "connections are disabled") {
+			t.Fatalf("expected %s to be denied by family, got %v", addr, err)
+		}
+		if blocked != 1 {
+			t.Fatalf("expected the denial of %s to be reported", addr)
+		}
+	}
+
+	_, err := NewTransport(Options{DenyIPv4: true, DenyIPv6: true})
+	if err == nil {
+		t.Fatalf("expected error denying both families")
+	}
+}
+
+// Test that malformed addresses are skipped, or fail resolution.
+func TestRequireAllAddressesResolvable(t *testing.T) {
+
+	resolver := newFakeResolver(map[string][]string{
+		"mixed.example":   {"1.1.1.1,garbage,2606:4700::1111"},
+		"garbage.example": {"garbage"},
+	})
+
+	for _, strict := range []bool{false, true} {
+
+		tr, err := NewTransport(Options{Resolver: resolver, RequireAllAddressesResolvable: strict})
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+
+		dest, err := _validate(context.Background(), tr, "mixed.example", "80")
+		if strict {
+			if err == nil || !strings.Contains(err.Error(), "malformed address resolved for mixed.example") {
+				t.Fatalf("expected a malformed address to fail resolution, got %v", err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if len(dest.ips) != 2 {
+				t.Fatalf("expected the malformed address to be skipped, got %v", dest.ips)
+			}
+		}
+
+		_, err = _validate(context.Background(), tr, "garbage.example", "80")
+		if err == nil {
+			t.Fatalf("expected error when only malformed addresses are resolved")
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package remotehttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Resolver is the interface used to resolve hostnames to IP addresses.
+//
+// It is satisfied by *net.Resolver, and allows a custom resolver to be
+// used in place of the system one.
+type Resolver interface {
+
+	// LookupIP looks up the given host, returning the IP addresses
+	// for the given network ("ip", "ip4", or "ip6").
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// ReverseResolver is the interface used to perform reverse lookups, which
+// a Resolver may optionally implement.
+//
+// It is satisfied by *net.Resolver.
+type ReverseResolver interface {
+
+	// LookupAddr returns the names which the given address maps to.
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// ASNResolver is the interface used to find the autonomous system (ASN)
+// to which an IP address belongs.
+//
+// There is no default implementation, as ASN data must be obtained from
+// an external source, such as a local database or a DNS-based service.
+type ASNResolver interface {
+
+	// LookupASN returns the ASN of the given address.
+	LookupASN(ctx context.Context, ip net.IP) (uint32, error)
+}
+
+// SRVResolver is the interface used to lookup SRV records, which a
+// Resolver may optionally implement.
+//
+// It is satisfied by *net.Resolver.
+type SRVResolver interface {
+
+	// LookupSRV returns the SRV records for the given service,
+	// protocol, and name.
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSSECResolver is the interface of a Resolver which performs DNSSEC
+// validation, which is required if RequireDNSSEC is set.
+//
+// Such a resolver should return a *DNSSECError from LookupIP if the
+// answer for a host cannot be validated.
+type DNSSECResolver interface {
+	Resolver
+
+	// ValidatesDNSSEC returns true if the answers returned by
+	// LookupIP have been validated.
+	ValidatesDNSSEC() bool
+}
+
+// DNSSECError is returned by a DNSSECResolver when the answer for a host
+// cannot be validated.
+//
+// Connections to such hosts are denied, rather than being treated as
+// resolution failures.
+type DNSSECError struct {
+
+	// Host is the name which was looked up.
+	Host string
+
+	// Bogus is true if validation of a signed answer failed, otherwise
+	// the answer was unsigned (i.e. insecure).
+	Bogus bool
+}
+
+// Error returns a description of the failure.
+func (d *DNSSECError) Error() string {
+	if d.Bogus {
+		return fmt.Sprintf("host %s is denied as its DNSSEC validation failed (bogus)", d.Host)
+	}
+	return fmt.Sprintf("host %s is denied as its answer is not signed (insecure)", d.Host)
+}
+
+// pinEntry is a single entry in our pin-cache.
+type pinEntry struct {
+
+	// The IP we connected to.
+	ip net.IP
+
+	// The time at which this entry expires.
+	expires time.Time
+}
+
+// pinCache remembers the IP address to which a given host was validated,
+// such that later connections re-use that same address rather than
+// re-resolving it.
+//
+// This prevents DNS rebinding attacks, where a host initially resolves
+// to a public address, and later to a local one.
+type pinCache struct {
+
+	// The lifetime of each entry.
+	ttl time.Duration
+
+	// The maximum number of entries to store.
+	size int
+
+	// Lock for our entries.
+	mutex sync.Mutex
+
+	// The entries we've stored, keyed by hostname.
+	entries map[string]pinEntry
+}
+
+// newPinCache creates a new pin-cache with the given TTL and size limit.
+func newPinCache(ttl time.Duration, size int) *pinCache {
+	return &pinCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]pinEntry),
+	}
+}
+
+// Get returns the pinned IP for the given host, if present and unexpired.
+func (p *pinCache) Get(host string) net.IP {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entry, ok := p.entries[host]
+	if !ok {
+		return nil
+	}
+
+	// Expired?  Then remove it.
+	if clock().After(entry.expires) {
+		delete(p.entries, host)
+		return nil
+	}
+	return entry.ip
+}
+
+// Set records the pinned IP for the given host.
+//
+// If the cache is full then expired entries are removed, and if that
+// doesn't make room the entry closest to expiry is evicted.
+func (p *pinCache) Set(host string, ip net.IP) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := clock()
+
+	if _, ok := p.entries[host]; !ok && len(p.entries) >= p.size {
+
+		// Remove expired entries, finding the oldest as we go.
+		oldest := ""
+		for name, entry := range p.entries {
+			if now.After(entry.expires) {
+				delete(p.entries, name)
+				continue
+			}
+			if oldest == "" || entry.expires.Before(p.entries[oldest].expires) {
+				oldest = name
+			}
+		}
+
+		// Still full?  Remove the oldest.
+		if len(p.entries) >= p.size {
+			delete(p.entries, oldest)
+		}
+	}
+
+	p.entries[host] = pinEntry{ip: ip, expires: now.Add(p.ttl)}
+}
+
+// Len returns the number of entries in the cache.
+func (p *pinCache) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.entries)
+}
+
+// Clear removes all entries from the cache.
+func (p *pinCache) Clear() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.entries = make(map[string]pinEntry)
+}
+
+// denyEntry is a single entry in our deny-cache.
+type denyEntry struct {
+
+	// The denial we made.
+	err LocalAddressError
+
+	// The time at which this entry expires.
+	expires time.Time
+}
+
+// denyCache remembers the hosts which were denied as they resolved to a
+// local address, such that later attempts fail without resolving them
+// again.
+//
+// Only denials are cached, so this can never cause a host to be permitted
+// which would otherwise be denied.
+type denyCache struct {
+
+	// The lifetime of each entry.
+	ttl time.Duration
+
+	// The maximum number of entries to store.
+	size int
+
+	// Lock for our entries.
+	mutex sync.Mutex
+
+	// The entries we've stored, keyed by hostname.
+	entries map[string]denyEntry
+}
+
+// newDenyCache creates a new deny-cache with the given TTL and size limit.
+func newDenyCache(ttl time.Duration, size int) *denyCache {
+	return &denyCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]denyEntry),
+	}
+}
+
+// Get returns the denial for the given host, if present and unexpired.
+func (d *denyCache) Get(host string) *LocalAddressError {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	entry, ok := d.entries[host]
+	if !ok {
+		return nil
+	}
+
+	// Expired?  Then remove it.
+	if clock().After(entry.expires) {
+		delete(d.entries, host)
+		return nil
+	}
+
+	// Return a copy, so our entry can't be modified.
+	err := entry.err
+	return &err
+}
+
+// Set records the denial for the given host.
+//
+// If the cache is full then expired entries are removed, and if that
+// doesn't make room the entry closest to expiry is evicted.
+func (d *denyCache) Set(host string, err *LocalAddressError) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := clock()
+
+	if _, ok := d.entries[host]; !ok && len(d.entries) >= d.size {
+
+		// Remove expired entries, finding the oldest as we go.
+		oldest := ""
+		for name, entry := range d.entries {
+			if now.After(entry.expires) {
+				delete(d.entries, name)
+				continue
+			}
+			if oldest == "" || entry.expires.Before(d.entries[oldest].expires) {
+				oldest = name
+			}
+		}
+
+		// Still full?  Remove the oldest.
+		if len(d.entries) >= d.size {
+			delete(d.entries, oldest)
+		}
+	}
+
+	d.entries[host] = denyEntry{err: *err, expires: now.Add(d.ttl)}
+}
+
+// Clear removes all entries from the cache.
+func (d *denyCache) Clear() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.entries = make(map[string]denyEntry)
+}
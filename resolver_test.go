@@ -0,0 +1,606 @@
+package remotehttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver is a Resolver which returns canned results.
+type fakeResolver struct {
+
+	// Lock for our state.
+	mutex sync.Mutex
+
+	// The results to return for each host, in turn.
+	//
+	// Once we've reached the last result it is returned forever.
+	results map[string][][]net.IP
+
+	// The number of lookups we've made for each host.
+	lookups map[string]int
+
+	// The results to return for reverse lookups, by address.
+	ptr map[string][]string
+
+	// The results to return for SRV lookups, by "_service._proto.name".
+	srv map[string][]*net.SRV
+}
+
+// newFakeResolver creates a fakeResolver which returns the given addresses
+// for each host, in turn.
+//
+// Each result is a comma-separated list of addresses, which may be empty.
+func newFakeResolver(results map[string][]string) *fakeResolver {
+	f := &fakeResolver{
+		results: make(map[string][][]net.IP),
+		lookups: make(map[string]int),
+	}
+	for host, entries := range results {
+		for _, entry := range entries {
+			var ips []net.IP
+			for _, ip := range strings.Split(entry, ",") {
+				if ip != "" {
+					ips = append(ips, net.ParseIP(ip))
+				}
+			}
+			f.results[host] = append(f.results[host], ips)
+		}
+	}
+	return f
+}
+
+// LookupIP returns the next canned result for the given host.
+func (f *fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// IP addresses resolve to themselves.
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	results, ok := f.results[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	n := f.lookups[host]
+	f.lookups[host]++
+	if n >= len(results) {
+		n = len(results) - 1
+	}
+
+	// Only return addresses of the requested family.
+	if network == "ip" {
+		return results[n], nil
+	}
+	var ips []net.IP
+	for _, ip := range results[n] {
+		if (ip.To4() != nil) == (network == "ip4") {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// LookupAddr returns the canned reverse lookup for the given address.
+func (f *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	names, ok := f.ptr[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+// LookupSRV returns the canned SRV records for the given service.
+func (f *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := "_" + service + "._" + proto + "." + name
+	addrs, ok := f.srv[key]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: key, IsNotFound: true}
+	}
+	return key, addrs, nil
+}
+
+// Lookups returns the number of lookups made for the given host.
+func (f *fakeResolver) Lookups(host string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.lookups[host]
+}
+
+// testServer starts a HTTP server on the loopback address, returning
+// it along with its port.
+func testServer(t *testing.T, handler http.Handler) (*httptest.Server, string) {
+	srv := httptest.NewServer(handler)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse test-server URL: %s", err.Error())
+	}
+	return srv, u.Port()
+}
+
+// okHandler is a simple HTTP handler which returns a fixed response.
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "OK")
+})
+
+// Test that pinning defeats a rebinding resolver.
+func TestPinning(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	for _, pin := range []bool{true, false} {
+
+		// The first lookup is for our (allowed) server, the second
+		// is for a local address.
+		opts := Options{
+			AllowCIDRs: []string{"127.0.0.1/32"},
+			Resolver: newFakeResolver(map[string][]string{
+				"rebind.example": {"127.0.0.1", "127.0.0.2"},
+			}),
+		}
+		if pin {
+			opts.PinTTL = time.Minute
+		}
+
+		tr, err := NewTransport(opts)
+		if err != nil {
+			t.Fatalf("unexpected error creating transport: %s", err.Error())
+		}
+		tr.DisableKeepAlives = true
+		client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+		// The first request succeeds in both cases.
+		resp, err := client.Get("http://rebind.example:" + port + "/")
+		if err != nil {
+			t.Fatalf("unexpected error with first request: %s", err.Error())
+		}
+		resp.Body.Close()
+
+		// The second request only succeeds if pinned.
+		resp, err = client.Get("http://rebind.example:" + port + "/")
+		if pin {
+			if err != nil {
+				t.Fatalf("unexpected error with pinned request: %s", err.Error())
+			}
+			resp.Body.Close()
+		} else {
+			if err == nil {
+				t.Fatalf("expected error with rebound request")
+			}
+		}
+	}
+}
+
+// Test that our pin-cache is bounded, and expires entries.
+func TestPinCache(t *testing.T) {
+
+	p := newPinCache(time.Minute, 2)
+	p.Set("a", net.ParseIP("1.1.1.1"))
+	p.Set("b", net.ParseIP("1.1.1.2"))
+	p.Set("c", net.ParseIP("1.1.1.3"))
+
+	if p.Len() != 2 {
+		t.Fatalf("expected cache to be bounded, got %d entries", p.Len())
+	}
+	if p.Get("a") != nil {
+		t.Fatalf("expected the oldest entry to be evicted")
+	}
+	if !p.Get("c").Equal(net.ParseIP("1.1.1.3")) {
+		t.Fatalf("expected the newest entry to be present")
+	}
+
+	f, restore := useFakeClock()
+	defer restore()
+
+	p = newPinCache(time.Minute, 2)
+	p.Set("a", net.ParseIP("1.1.1.1"))
+	f.Advance(59 * time.Second)
+	if p.Get("a") == nil {
+		t.Fatalf("expected the entry to be present before it expires")
+	}
+	f.Advance(2 * time.Second)
+	if p.Get("a") != nil {
+		t.Fatalf("expected the entry to expire")
+	}
+}
+
+// slowResolver is a Resolver which never returns, until cancelled.
+type slowResolver struct{}
+
+// LookupIP waits for the context to be cancelled.
+func (s slowResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// Test that denied hosts are cached, and not resolved again.
+func TestDenyCache(t *testing.T) {
+
+	f, restore := useFakeClock()
+	defer restore()
+
+	resolver := newFakeResolver(map[string][]string{
+		"bad.example":  {"127.0.0.1"},
+		"good.example": {"1.1.1.1"},
+	})
+	tr, err := NewTransport(Options{Resolver: resolver, DenyCacheTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	expected := "host bad.example rejected: ip address 127.0.0.1 is denied as local (loopback)"
+	for i := 0; i < 3; i++ {
+		err = tr.IsSafeURL(context.Background(), "http://bad.example/")
+		if err == nil || err.Error() != expected {
+			t.Fatalf("expected error %q, got %v", expected, err)
+		}
+		var local *LocalAddressError
+		if !errors.As(err, &local) {
+			t.Fatalf("expected a LocalAddressError, got %T", err)
+		}
+	}
+	if resolver.Lookups("bad.example") != 1 {
+		t.Fatalf("expected a single lookup, got %d", resolver.Lookups("bad.example"))
+	}
+
+	// Permitted hosts aren't cached.
+	for i := 0; i < 3; i++ {
+		if err = tr.IsSafeURL(context.Background(), "http://good.example/"); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	if resolver.Lookups("good.example") != 3 {
+		t.Fatalf("expected a lookup each time, got %d", resolver.Lookups("good.example"))
+	}
+
+	// Once expired the host is resolved again.
+	f.Advance(2 * time.Minute)
+	if tr.IsSafeURL(context.Background(), "http://bad.example/") == nil {
+		t.Fatalf("expected error")
+	}
+	if resolver.Lookups("bad.example") != 2 {
+		t.Fatalf("expected a new lookup after expiry, got %d", resolver.Lookups("bad.example"))
+	}
+
+	_, err = NewTransport(Options{DenyCacheTTL: -1})
+	if err == nil {
+		t.Fatalf("expected error with a negative TTL")
+	}
+}
+
+// Test that resolution may be limited independently of the request.
+func TestResolveTimeout(t *testing.T) {
+
+	tr, err := NewTransport(Options{
+		Resolver:       slowResolver{},
+		ResolveTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err = tr.DialContext(ctx, "tcp", "slow.example:80")
+	if err == nil {
+		t.Fatalf("expected error resolving via a slow resolver")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("resolution took too long: %s", time.Since(start))
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("the request context expired before resolution")
+	}
+
+	// Negative timeouts are invalid.
+	_, err = NewTransport(Options{ResolveTimeout: -1})
+	if err == nil {
+		t.Fatalf("expected error with a negative timeout")
+	}
+}
+
+// Test that addresses may be denied by their PTR records.
+func TestBlockByPTRSuffix(t *testing.T) {
+
+	resolver := newFakeResolver(map[string][]string{
+		"public.example":  {"1.1.1.1"},
+		"sneaky.example":  {"1.1.1.2"},
+		"unknown.example": {"1.1.1.3"},
+	})
+	resolver.ptr = map[string][]string{
+		"1.1.1.1": {"one.one.one.one."},
+		"1.1.1.2": {"db1.corp.INTERNAL."},
+	}
+
+	tr, err := NewTransport(Options{
+		Resolver:         resolver,
+		BlockByPTRSuffix: []string{".internal"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	tests := map[string]bool{
+		"http://public.example/":  true,
+		"http://unknown.example/": true,
+		"http://sneaky.example/":  false,
+	}
+
+	for u, safe := range tests {
+		err = tr.IsSafeURL(context.Background(), u)
+		if safe && err != nil {
+			t.Fatalf("unexpected error validating %s: %s", u, err.Error())
+		}
+		if !safe {
+			if err == nil {
+				t.Fatalf("expected error validating %s", u)
+			}
+			if !strings.Contains(err.Error(), "resolves to db1.corp.internal") {
+				t.Fatalf("Received an error, but not the expected one.  Got: %s", err.Error())
+			}
+		}
+	}
+
+	// Resolvers must support reverse lookups.
+	_, err = NewTransport(Options{
+		Resolver:         slowResolver{},
+		BlockByPTRSuffix: []string{"internal"},
+	})
+	if err == nil {
+		t.Fatalf("expected error with a resolver lacking reverse lookups")
+	}
+}
+
+// fakeASNResolver is an ASNResolver which returns canned results.
+type fakeASNResolver map[string]uint32
+
+// LookupASN returns the canned ASN for the given address.
+func (f fakeASNResolver) LookupASN(ctx context.Context, ip net.IP) (uint32, error) {
+	asn, ok := f[ip.String()]
+	if !ok {
+		return 0, fmt.Errorf("no ASN found for %s", ip)
+	}
+	return asn, nil
+}
+
+// Test that addresses may be denied by their ASN.
+func TestDenyASNs(t *testing.T) {
+
+	tr, err := NewTransport(Options{
+		Resolver: newFakeResolver(map[string][]string{
+			"good.example":  {"1.1.1.1"},
+			"bad.example":   {"1.1.1.1,2.2.2.2"},
+			"other.example": {"3.3.3.3"},
+		}),
+		DenyASNs: []uint32{64666},
+		ASNResolver: fakeASNResolver{
+			"1.1.1.1": 13335,
+			"2.2.2.2": 64666,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	tests := map[string]string{
+		"http://good.example/":  "",
+		"http://bad.example/":   "ip address 2.2.2.2 is denied as it belongs to AS64666",
+		"http://other.example/": "failed to lookup ASN of ip address 3.3.3.3",
+	}
+
+	for u, expected := range tests {
+		err = tr.IsSafeURL(context.Background(), u)
+		if expected == "" {
+			if err != nil {
+				t.Fatalf("unexpected error validating %s: %s", u, err.Error())
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected error %q validating %s, got %v", expected, u, err)
+		}
+	}
+
+	// A resolver is required.
+	_, err = NewTransport(Options{DenyASNs: []uint32{64666}})
+	if err == nil {
+		t.Fatalf("expected error without an ASN resolver")
+	}
+}
+
+// Test that hosts may be overridden, and are still checked.
+func TestHostIPOverrides(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	tr, err := NewTransport(Options{
+		AllowCIDRs: []string{"127.0.0.1/32"},
+		Resolver:   newFakeResolver(nil),
+		HostIPOverrides: map[string]string{
+			"API.example":  "127.0.0.1",
+			"evil.example": "127.0.0.2",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	resp, err := client.Get("http://api.example:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error fetching overridden host: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	_, err = client.Get("http://evil.example:" + port + "/")
+	if err == nil {
+		t.Fatalf("expected error fetching local override")
+	}
+	if !strings.Contains(err.Error(), "127.0.0.2 is denied as local") {
+		t.Fatalf("Received an error, but not the expected one.  Got: %s", err.Error())
+	}
+
+	// Invalid overrides are rejected.
+	_, err = NewTransport(Options{HostIPOverrides: map[string]string{"a.example": "steve"}})
+	if err == nil {
+		t.Fatalf("expected error with an invalid override")
+	}
+}
+
+// dnssecResolver is a DNSSECResolver which fails validation of some hosts.
+type dnssecResolver struct {
+	*fakeResolver
+
+	// The hosts whose answers are bogus, or insecure.
+	bogus    map[string]bool
+	insecure map[string]bool
+}
+
+// LookupIP returns an error for our bogus and insecure hosts.
+func (d *dnssecResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if d.bogus[host] {
+		return nil, &DNSSECError{Host: host, Bogus: true}
+	}
+	if d.insecure[host] {
+		return nil, &DNSSECError{Host: host}
+	}
+	return d.fakeResolver.LookupIP(ctx, network, host)
+}
+
+// ValidatesDNSSEC returns true, as we validate answers.
+func (d *dnssecResolver) ValidatesDNSSEC() bool {
+	return true
+}
+
+// Test that DNSSEC validation failures are denials.
+func TestRequireDNSSEC(t *testing.T) {
+
+	resolver := &dnssecResolver{
+		fakeResolver: newFakeResolver(map[string][]string{"signed.example": {"1.1.1.1"}}),
+		bogus:        map[string]bool{"bogus.example": true},
+		insecure:     map[string]bool{"unsigned.example": true},
+	}
+
+	var blocked []string
+	tr, err := NewTransport(Options{
+		Resolver:      resolver,
+		RequireDNSSEC: true,
+		OnBlock: func(info ConnInfo, err error) {
+			blocked = append(blocked, info.Host)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	tests := map[string]string{
+		"signed.example":   "",
+		"bogus.example":    "DNSSEC validation failed (bogus)",
+		"unsigned.example": "not signed (insecure)",
+	}
+
+	for host, expected := range tests {
+		if expected == "" {
+			if err = tr.IsSafeURL(context.Background(), "http://"+host+"/"); err != nil {
+				t.Fatalf("unexpected error for %s: %s", host, err.Error())
+			}
+			continue
+		}
+		_, err = tr.DialContext(context.Background(), "tcp", host+":80")
+		var dnssec *DNSSECError
+		if !errors.As(err, &dnssec) || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected error %q for %s, got %v", expected, host, err)
+		}
+	}
+
+	// Both failures are reported as denials.
+	if len(blocked) != 2 {
+		t.Fatalf("expected two denials to be reported, got %v", blocked)
+	}
+
+	// A validating resolver is required.
+	_, err = NewTransport(Options{RequireDNSSEC: true, Resolver: newFakeResolver(nil)})
+	if err == nil {
+		t.Fatalf("expected error without a validating resolver")
+	}
+}
+
+// Test that each resolution is reported, before it is checked.
+func TestOnResolve(t *testing.T) {
+
+	var mutex sync.Mutex
+	resolved := make(map[string][]net.IP)
+
+	tr, err := NewTransport(Options{
+		Resolver: newFakeResolver(map[string][]string{
+			"mixed.example":  {"1.1.1.1,10.0.0.1,fd00::1"},
+			"public.example": {"1.1.1.1"},
+		}),
+		HostIPOverrides: map[string]string{"override.example": "1.1.1.1"},
+		OnResolve: func(host string, ips []net.IP) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			resolved[host] = ips
+
+			// Changes don't affect the addresses we check.
+			for i := range ips {
+				ips[i] = net.ParseIP("1.1.1.1")
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	ctx := context.Background()
+	if _, err = _validate(ctx, tr, "mixed.example", "80"); err == nil {
+		t.Fatalf("expected a host with local addresses to be denied")
+	}
+	if _, err = _validate(ctx, tr, "public.example", "80"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, err = _validate(ctx, tr, "override.example", "80"); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if _, err = _validate(ctx, tr, "missing.example", "80"); err == nil {
+		t.Fatalf("expected an unknown host to fail")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(resolved) != 2 {
+		t.Fatalf("unexpected resolutions %v", resolved)
+	}
+	if fmt.Sprint(resolved["public.example"]) != "[1.1.1.1]" {
+		t.Fatalf("unexpected addresses %v", resolved["public.example"])
+	}
+	if len(resolved["mixed.example"]) != 3 {
+		t.Fatalf("expected the full set of addresses, got %v", resolved["mixed.example"])
+	}
+}
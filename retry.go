@@ -0,0 +1,156 @@
+package remotehttp
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RetryRoundTripper is a http.RoundTripper which retries idempotent
+// requests, made via another RoundTripper, which fail transiently.
+//
+// GET and HEAD requests are retried if a connection can't be made, the
+// connection fails, or the server responds with a 5xx status.  Requests
+// which are denied, such as those to local addresses, are never retried.
+// Between attempts we wait with exponential backoff, and jitter, so that
+// many clients don't retry in step.
+type RetryRoundTripper struct {
+
+	// Transport is the RoundTripper which makes each attempt.
+	//
+	// If nil a SafeTransport, using the options set via
+	// SetDefaultOptions, is used.
+	Transport http.RoundTripper
+
+	// MaxAttempts is the most times a request will be made.
+	//
+	// If zero a default of 3 is used.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry, which doubles for
+	// each retry after it.  Each delay is reduced by a random amount
+	// of up to half.
+	//
+	// If zero a default of 100ms is used.
+	Backoff time.Duration
+
+	// MaxBackoff limits the delay between attempts.
+	//
+	// If zero there is no limit.
+	MaxBackoff time.Duration
+}
+
+// RoundTrip makes the given request, retrying it if it fails
+// transiently.
+//
+// If every attempt fails the last error, or 5xx response, is returned.
+func (r *RetryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	transport := r.Transport
+	if transport == nil {
+		transport = getDefaultTransport()
+	}
+
+	attempts := r.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+
+	// Only idempotent requests are retried, and only if we can send
+	// their body again.
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) ||
+		(req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+
+		resp, err := transport.RoundTrip(req)
+		if attempt >= attempts || !_shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		// Discard the failed response.
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		// Wait before we try again.
+		timer := time.NewTimer(r.delay(attempt))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		// Rewind the body, if any.
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// delay returns how long to wait after the given (failed) attempt.
+func (r *RetryRoundTripper) delay(attempt int) time.Duration {
+
+	d := r.Backoff
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if r.MaxBackoff > 0 && d >= r.MaxBackoff {
+			break
+		}
+	}
+	if r.MaxBackoff > 0 && d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+
+	// Remove up to half, at random.
+	if half := int64(d / 2); half > 0 {
+		random.Lock()
+		d -= time.Duration(random.Int63n(half))
+		random.Unlock()
+	}
+	return d
+}
+
+// CloseIdleConnections closes the idle connections of our transport, if
+// it supports doing so.
+func (r *RetryRoundTripper) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if c, ok := r.Transport.(closeIdler); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// _shouldRetry returns true if the given outcome of a request is worth
+// retrying.
+//
+// Denials are never retried, while failures to connect, transient
+// connection errors, and 5xx responses are.
+func _shouldRetry(resp *http.Response, err error) bool {
+
+	if err == nil {
+		return resp.StatusCode >= 500
+	}
+
+	var local *LocalAddressError
+	if errors.As(err, &local) {
+		return false
+	}
+
+	var ce *ConnectError
+	return errors.As(err, &ce) || _isTransient(err)
+}
@@ -0,0 +1,154 @@
+package remotehttp
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingTransport is a http.RoundTripper which counts the requests made
+// via another.
+type countingTransport struct {
+	http.RoundTripper
+
+	mutex    sync.Mutex
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mutex.Lock()
+	c.requests++
+	c.mutex.Unlock()
+	return c.RoundTripper.RoundTrip(req)
+}
+
+func (c *countingTransport) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.requests
+}
+
+// Test that transient failures are retried, and denials are not.
+func TestRetryRoundTripper(t *testing.T) {
+
+	// A handler which fails twice, then succeeds.
+	var mutex sync.Mutex
+	failures := 0
+	flaky := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failures < 2 {
+			failures++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+	reset := func() {
+		mutex.Lock()
+		failures = 0
+		mutex.Unlock()
+	}
+	srv, port := testServer(t, flaky)
+	defer srv.Close()
+
+	tr, err := NewTransport(Options{AllowCIDRs: []string{"127.0.0.1/32"}})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	newClient := func(attempts int) (*http.Client, *countingTransport) {
+		counter := &countingTransport{RoundTripper: tr}
+		retry := &RetryRoundTripper{Transport: counter, MaxAttempts: attempts, Backoff: time.Millisecond}
+		return &http.Client{Transport: retry, Timeout: 5 * time.Second}, counter
+	}
+
+	// The flaky handler succeeds on the third attempt.
+	client, counter := newClient(3)
+	resp, err := client.Get("http://127.0.0.1:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || counter.count() != 3 {
+		t.Fatalf("unexpected status %d after %d attempts", resp.StatusCode, counter.count())
+	}
+
+	// But the last failure is returned if we give up first.
+	reset()
+	client, counter = newClient(2)
+	resp, err = client.Get("http://127.0.0.1:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || counter.count() != 2 {
+		t.Fatalf("unexpected status %d after %d attempts", resp.StatusCode, counter.count())
+	}
+
+	// Requests which aren't idempotent aren't retried.
+	reset()
+	client, counter = newClient(3)
+	resp, err = client.Post("http://127.0.0.1:"+port+"/", "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || counter.count() != 1 {
+		t.Fatalf("unexpected status %d after %d attempts", resp.StatusCode, counter.count())
+	}
+
+	// Local denials aren't retried.
+	client, counter = newClient(3)
+	_, err = client.Get("http://127.0.0.2:" + port + "/")
+	if err == nil {
+		t.Fatalf("expected error fetching a local address")
+	}
+	if counter.count() != 1 {
+		t.Fatalf("expected a single attempt, got %d", counter.count())
+	}
+
+	// Failures to connect are.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	client, counter = newClient(3)
+	_, err = client.Get("http://" + closed + "/")
+	if err == nil {
+		t.Fatalf("expected error connecting to a closed port")
+	}
+	if counter.count() != 3 {
+		t.Fatalf("expected three attempts, got %d", counter.count())
+	}
+}
+
+// Test that our delays grow, and are limited.
+func TestRetryDelay(t *testing.T) {
+
+	r := &RetryRoundTripper{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{10, 500 * time.Millisecond, time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			d := r.delay(test.attempt)
+			if d < test.min || d > test.max {
+				t.Fatalf("attempt %d: delay %s outside %s-%s", test.attempt, d, test.min, test.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package remotehttp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// errShuttingDown is returned when a connection is attempted after
+// Shutdown has been called.
+var errShuttingDown = errors.New("transport is shutting down")
+
+// connTracker records the connections which are open, so that we may
+// wait for them to be closed when shutting down.
+type connTracker struct {
+
+	// Lock for our state.
+	mutex sync.Mutex
+
+	// Are we shutting down?
+	stopping bool
+
+	// The number of open connections.
+	active int
+}
+
+// stopped returns true if we're shutting down.
+func (c *connTracker) stopped() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.stopping
+}
+
+// stop marks us as shutting down, and returns the number of connections
+// which are still open.
+func (c *connTracker) stop() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.stopping = true
+	return c.active
+}
+
+// count returns the number of open connections.
+func (c *connTracker) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.active
+}
+
+// track records the given connection, until it is closed.
+//
+// If we're shutting down the connection is closed, and an error returned.
+func (c *connTracker) track(con net.Conn) (net.Conn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stopping {
+		con.Close()
+		return nil, errShuttingDown
+	}
+	c.active++
+	return &trackedConn{Conn: con, tracker: c}, nil
+}
+
+// release records that a connection has been closed.
+func (c *connTracker) release() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.active--
+}
+
+// trackedConn is a net.Conn which is released from its tracker when closed.
+type trackedConn struct {
+	net.Conn
+
+	// The tracker we release.
+	tracker *connTracker
+
+	// Ensures we only release once.
+	once sync.Once
+}
+
+// Close closes the connection, and releases it from our tracker.
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.tracker.release)
+	return err
+}
+
+// Shutdown gracefully shuts down the transport.
+//
+// New connections are refused, returning an error, and then we wait for
+// the connections which are open to be closed.  Idle connections are
+// closed immediately, and those which are in use are closed once their
+// requests are complete.  If the context expires first its error is
+// returned.
+//
+// Requests which can re-use an idle connection may still be made, until
+// it is closed.  The transport may not be used after Shutdown.
+func (t *SafeTransport) Shutdown(ctx context.Context) error {
+
+	if t.conns.stop() == 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		// Connections become idle when their requests are
+		// complete, so close them as they do.
+		t.CloseIdleConnections()
+		if t.conns.count() == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package remotehttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Test that shutting down refuses new connections, and waits for those
+// in use.
+func TestShutdown(t *testing.T) {
+
+	entered := make(chan bool, 1)
+	release := make(chan bool)
+	srv, port := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- true
+			<-release
+		}
+		w.Write([]byte("done"))
+	}))
+	defer srv.Close()
+
+	tr, err := NewTransport(Options{AllowCIDRs: []string{"127.0.0.1/32"}})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	// Leave an idle connection, which is closed immediately.
+	resp, err := client.Get("http://127.0.0.1:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// Start a request which is in-flight when we shutdown.
+	result := make(chan string)
+	go func() {
+		resp, err := client.Get("http://127.0.0.1:" + port + "/slow")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		result <- string(body)
+	}()
+	<-entered
+
+	stopped := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- tr.Shutdown(ctx)
+	}()
+	for !tr.conns.stopped() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// New connections are refused.
+	_, err = tr.DialContext(context.Background(), "tcp", "127.0.0.1:"+port)
+	if err != errShuttingDown {
+		t.Fatalf("expected new connections to be refused, got %v", err)
+	}
+
+	// The in-flight request completes, and then we're done.
+	select {
+	case <-stopped:
+		t.Fatalf("shutdown completed with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if body := <-result; body != "done" {
+		t.Fatalf("unexpected result of the in-flight request: %s", body)
+	}
+	if err = <-stopped; err != nil {
+		t.Fatalf("unexpected error shutting down: %s", err.Error())
+	}
+	if tr.conns.count() != 0 {
+		t.Fatalf("expected no connections to remain, got %d", tr.conns.count())
+	}
+}
+
+// Test that shutting down gives up when the context expires.
+func TestShutdownTimeout(t *testing.T) {
+
+	release := make(chan bool)
+	srv, port := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	tr, err := NewTransport(Options{AllowCIDRs: []string{"127.0.0.1/32"}})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+	go client.Get("http://127.0.0.1:" + port + "/")
+
+	for tr.conns.count() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = tr.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+}
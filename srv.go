@@ -0,0 +1,61 @@
+package remotehttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ResolveAndValidateSRV looks up the SRV records for the given service,
+// returning the targets which are permitted by the options set via
+// SetDefaultOptions.
+//
+// See SafeTransport.ResolveAndValidateSRV for details.
+func ResolveAndValidateSRV(ctx context.Context, service, proto, name string) ([]string, error) {
+	return getDefaultTransport().ResolveAndValidateSRV(ctx, service, proto, name)
+}
+
+// ResolveAndValidateSRV looks up the SRV records for the given service,
+// returning the targets which are permitted by this transport, as
+// "host:port" strings, in priority order.
+//
+// Each target is resolved and validated in the same way as when a
+// connection is made, and those which are denied are skipped.  If no
+// targets are permitted then an error is returned.  The resolver must
+// implement SRVResolver.
+//
+// As with IsSafeURL a target which is safe now might not be safe when it
+// is later used, so connections should still be made via our transport.
+func (t *SafeTransport) ResolveAndValidateSRV(ctx context.Context, service, proto, name string) ([]string, error) {
+
+	resolver, ok := t.resolver.(SRVResolver)
+	if !ok {
+		return nil, fmt.Errorf("resolver does not support SRV lookups")
+	}
+
+	_, addrs, err := resolver.LookupSRV(ctx, service, proto, name)
+	if err != nil {
+		return nil, &resolveError{err: err}
+	}
+
+	var targets []string
+	for _, addr := range addrs {
+		port := strconv.Itoa(int(addr.Port))
+
+		// Skip the targets which are denied.
+		_, err = _validate(ctx, t, addr.Target, port)
+		if err != nil {
+			continue
+		}
+		targets = append(targets, net.JoinHostPort(addr.Target, port))
+	}
+
+	if len(targets) < 1 {
+		if err == nil {
+			err = fmt.Errorf("no SRV records found")
+		}
+		return nil, fmt.Errorf("no permitted SRV targets for %s: %s", name, err)
+	}
+	return targets, nil
+}
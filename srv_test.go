@@ -0,0 +1,75 @@
+package remotehttp
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Test that SRV targets are validated.
+func TestResolveAndValidateSRV(t *testing.T) {
+
+	resolver := newFakeResolver(map[string][]string{
+		"public.example":  {"1.2.3.4"},
+		"private.example": {"10.0.0.1"},
+		"mixed.example":   {"1.2.3.5,127.0.0.1"},
+	})
+	resolver.srv = map[string][]*net.SRV{
+		"_http._tcp.mixed.example": {
+			{Target: "public.example.", Port: 8080},
+			{Target: "private.example.", Port: 8080},
+			{Target: "mixed.example.", Port: 80},
+			{Target: "missing.example.", Port: 80},
+			{Target: "1.2.3.6", Port: 443},
+		},
+		"_http._tcp.private.example": {
+			{Target: "private.example.", Port: 80},
+		},
+		"_http._tcp.empty.example": {},
+	}
+
+	tr, err := NewTransport(Options{Resolver: resolver})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	// Only the public targets are returned.
+	targets, err := tr.ResolveAndValidateSRV(context.Background(), "http", "tcp", "mixed.example")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expected := []string{"public.example.:8080", "1.2.3.6:443"}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Fatalf("expected %v, got %v", expected, targets)
+	}
+
+	type TestCase struct {
+		name  string
+		error string
+	}
+
+	tests := []TestCase{
+		{"private.example", "ip address 10.0.0.1 is denied as local"},
+		{"empty.example", "no SRV records found"},
+		{"missing.example", "no such host"},
+	}
+
+	for _, test := range tests {
+		_, err := tr.ResolveAndValidateSRV(context.Background(), "http", "tcp", test.name)
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Fatalf("expected error containing %q for %s, got %v", test.error, test.name, err)
+		}
+	}
+
+	// A resolver without SRV support is an error.
+	tr, err = NewTransport(Options{Resolver: slowResolver{}})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	_, err = tr.ResolveAndValidateSRV(context.Background(), "http", "tcp", "mixed.example")
+	if err == nil || !strings.Contains(err.Error(), "does not support SRV") {
+		t.Fatalf("expected an unsupported error, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package remotehttp
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// throttledConn is a net.Conn whose reads and writes are limited to a
+// number of bytes per second.
+type throttledConn struct {
+	net.Conn
+
+	// The limits for reading, and writing.
+	read  *rate.Limiter
+	write *rate.Limiter
+
+	// Our context, which is cancelled when we're closed so that any
+	// waits are abandoned.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newThrottledConn wraps the given connection, limiting it to the given
+// number of bytes per second in each direction.
+//
+// The burst of each limiter is a tenth of a second's data, so that the
+// rate is applied smoothly.
+func newThrottledConn(con net.Conn, bps int) *throttledConn {
+
+	burst := bps / 10
+	if burst < 1 {
+		burst = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &throttledConn{
+		Conn:   con,
+		read:   rate.NewLimiter(rate.Limit(bps), burst),
+		write:  rate.NewLimiter(rate.Limit(bps), burst),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Read reads from the connection, waiting for our limit afterwards.
+func (c *throttledConn) Read(b []byte) (int, error) {
+
+	if len(b) > c.read.Burst() {
+		b = b[:c.read.Burst()]
+	}
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := c.read.WaitN(c.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// Write writes to the connection, in chunks which our limit permits.
+func (c *throttledConn) Write(b []byte) (int, error) {
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > c.write.Burst() {
+			chunk = chunk[:c.write.Burst()]
+		}
+
+		if err := c.write.WaitN(c.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes the connection, abandoning any waits.
+func (c *throttledConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
@@ -0,0 +1,80 @@
+package remotehttp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Test that downloads may be throttled.
+func TestBytesPerSecond(t *testing.T) {
+
+	srv, port := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 25000))
+	}))
+	defer srv.Close()
+
+	opts := DefaultOptions()
+	opts.AllowCIDRs = []string{"127.0.0.1/32"}
+	opts.BytesPerSecond = 50000
+
+	c, err := NewClient(opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %s", err.Error())
+	}
+
+	start := time.Now()
+	resp, err := c.Get("http://127.0.0.1:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 25000 {
+		t.Fatalf("unexpected body of %d bytes: %v", len(body), err)
+	}
+
+	// At 50k a second, after our burst of 5k, we should take at
+	// least 0.4 seconds.  Allow some slack either way.
+	taken := time.Since(start)
+	if taken < 350*time.Millisecond || taken > 3*time.Second {
+		t.Fatalf("download took %s, which isn't close to our rate", taken)
+	}
+
+	// Negative rates are rejected.
+	if _, err = NewTransport(Options{BytesPerSecond: -1}); err == nil {
+		t.Fatalf("expected error with a negative rate")
+	}
+}
+
+// Test that writes are throttled, and that closing abandons waiting.
+func TestThrottledConnWrite(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	con := newThrottledConn(client, 10000)
+
+	start := time.Now()
+	n, err := con.Write(bytes.Repeat([]byte("x"), 3000))
+	if err != nil || n != 3000 {
+		t.Fatalf("unexpected write of %d bytes: %v", n, err)
+	}
+	if taken := time.Since(start); taken < 150*time.Millisecond {
+		t.Fatalf("write took %s, which is faster than our rate", taken)
+	}
+
+	// A large write is abandoned once we're closed.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		con.Close()
+	}()
+	_, err = con.Write(bytes.Repeat([]byte("x"), 100000))
+	if err == nil {
+		t.Fatalf("expected error writing to a closed connection")
+	}
+}
@@ -0,0 +1,92 @@
+package remotehttp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// SafeTLSConfig returns a copy of the given TLS configuration, which is
+// suitable for use with connections made via our DialContext.
+//
+// We connect to the (validated) IP address a host resolved to, rather than
+// its name, so certificates must be verified against the original hostname
+// rather than the address we dialled.  http.Transport does this by setting
+// the ServerName of each connection from the request's URL, and the config
+// returned here ensures that verification can't be disabled:
+//
+// * InsecureSkipVerify is cleared, so certificates are always checked.
+//
+// * Connections without a ServerName are rejected, rather than being
+// verified against nothing.
+//
+// * The minimum version is raised to TLS 1.2, if lower.
+//
+// Any VerifyConnection function of the base config is still called.  The
+// returned config may be used as the TLSClientConfig of a transport which
+// has been wrapped via WrapClient, or of our own transport.
+func SafeTLSConfig(base *tls.Config) *tls.Config {
+
+	var cfg *tls.Config
+	if base == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = base.Clone()
+	}
+
+	cfg.InsecureSkipVerify = false
+	if cfg.MinVersion < tls.VersionTLS12 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if cs.ServerName == "" {
+			return fmt.Errorf("tls connection has no server name to verify")
+		}
+		if verify != nil {
+			return verify(cs)
+		}
+		return nil
+	}
+	return cfg
+}
+
+// _dialTLS makes a TLS connection to the given address, via our checker,
+// limiting the whole process to our connection budget.
+//
+// The connection is configured by the transport's TLSClientConfig, and
+// the *tls.Conn is returned unwrapped, so that http.Transport can see if
+// HTTP/2 was negotiated.
+func _dialTLS(ctx context.Context, t *SafeTransport, network, addr string) (net.Conn, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, t.options.ConnectBudget)
+	defer cancel()
+
+	con, err := _checker(ctx, t, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg *tls.Config
+	if t.TLSClientConfig == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = t.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		cfg.ServerName = host
+	}
+	if len(cfg.NextProtos) == 0 && t.ForceAttemptHTTP2 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	tc := tls.Client(con, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		con.Close()
+		return nil, err
+	}
+	return tc, nil
+}
@@ -0,0 +1,245 @@
+package remotehttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that certificates are verified against the hostname, when we've
+// connected to a validated address.
+func TestSafeTLSConfig(t *testing.T) {
+
+	cert := testCertificate(t, "secure.example", "secure.example")
+
+	srv := httptest.NewUnstartedServer(okHandler)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %s", err.Error())
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	tr, err := NewTransport(Options{
+		AllowCIDRs: []string{"127.0.0.1/32"},
+		Resolver: newFakeResolver(map[string][]string{
+			"secure.example": {"127.0.0.1"},
+			"other.example":  {"127.0.0.1"},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+
+	// Verification can't be disabled.
+	base := &tls.Config{RootCAs: roots, InsecureSkipVerify: true, MinVersion: tls.VersionTLS10}
+	tr.TLSClientConfig = SafeTLSConfig(base)
+	if !base.InsecureSkipVerify || base.MinVersion != tls.VersionTLS10 {
+		t.Fatalf("the base config was modified")
+	}
+	if tr.TLSClientConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("unexpected minimum version %x", tr.TLSClientConfig.MinVersion)
+	}
+
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	// The certificate names the host we requested, though we
+	// connected to its address.
+	resp, err := client.Get(fmt.Sprintf("https://secure.example:%s/", port))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	// But not this host, despite it resolving to the same address.
+	_, err = client.Get(fmt.Sprintf("https://other.example:%s/", port))
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected a certificate error, got %v", err)
+	}
+
+	// Connections without a server name are rejected.
+	cfg := SafeTLSConfig(nil)
+	err = cfg.VerifyConnection(tls.ConnectionState{})
+	if err == nil {
+		t.Fatalf("expected error without a server name")
+	}
+
+	// And the base VerifyConnection is still called.
+	cfg = SafeTLSConfig(&tls.Config{VerifyConnection: func(cs tls.ConnectionState) error {
+		return fmt.Errorf("denied by base")
+	}})
+	err = cfg.VerifyConnection(tls.ConnectionState{ServerName: "secure.example"})
+	if err == nil || err.Error() != "denied by base" {
+		t.Fatalf("expected the base function to be called, got %v", err)
+	}
+}
+
+// Test that connection setup may be limited by a single budget.
+func TestConnectBudget(t *testing.T) {
+
+	// A permitted TLS connection is made as normal.
+	cert := testCertificate(t, "secure.example", "secure.example")
+	srv := httptest.NewUnstartedServer(okHandler)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	tr, err := NewTransport(Options{
+		AllowCIDRs:    []string{"127.0.0.1/32"},
+		ConnectBudget: 5 * time.Second,
+		Resolver:      newFakeResolver(map[string][]string{"secure.example": {"127.0.0.1"}}),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	tr.TLSClientConfig = &tls.Config{RootCAs: roots}
+	client := &http.Client{Transport: tr, Timeout: 10 * time.Second}
+
+	resp, err := client.Get("https://secure.example:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	// Slow resolution exceeds the budget.
+	tr, err = NewTransport(Options{ConnectBudget: 100 * time.Millisecond, Resolver: slowResolver{}})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client = &http.Client{Transport: tr, Timeout: 10 * time.Second}
+
+	start := time.Now()
+	if _, err = client.Get("http://slow.example/"); err == nil {
+		t.Fatalf("expected slow resolution to fail")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("slow resolution took %s", time.Since(start))
+	}
+
+	// As does a stalled TLS handshake, well before the handshake
+	// timeout.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	defer l.Close()
+	go func() {
+		for {
+			con, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer con.Close()
+		}
+	}()
+	_, port, _ = net.SplitHostPort(l.Addr().String())
+
+	tr, err = NewTransport(Options{
+		AllowCIDRs:    []string{"127.0.0.1/32"},
+		ConnectBudget: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client = &http.Client{Transport: tr, Timeout: 10 * time.Second}
+
+	start = time.Now()
+	if _, err = client.Get("https://127.0.0.1:" + port + "/"); err == nil {
+		t.Fatalf("expected a stalled handshake to fail")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("stalled handshake took %s", time.Since(start))
+	}
+
+	// Negative budgets are rejected.
+	if _, err = NewTransport(Options{ConnectBudget: -1}); err == nil {
+		t.Fatalf("expected error with a negative budget")
+	}
+}
+
+// Test that the TLS version, and cipher suites, may be restricted.
+func TestTLSVersionAndSuites(t *testing.T) {
+
+	cert := testCertificate(t, "secure.example", "secure.example")
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	// Start a server offering only the given versions and suites.
+	server := func(minVersion, maxVersion uint16, suites []uint16) string {
+		srv := httptest.NewUnstartedServer(okHandler)
+		srv.TLS = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   minVersion,
+			MaxVersion:   maxVersion,
+			CipherSuites: suites,
+		}
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		return port
+	}
+	cbc := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}
+	tls10 := server(tls.VersionTLS10, tls.VersionTLS10, cbc)
+	tls12 := server(tls.VersionTLS12, tls.VersionTLS12, cbc)
+
+	tests := []struct {
+		port    string
+		opts    Options
+		refused bool
+	}{
+		{tls10, Options{}, true},
+		{tls10, Options{MinTLSVersion: tls.VersionTLS10}, false},
+		{tls12, Options{}, false},
+		{tls12, Options{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}, true},
+		{tls12, Options{CipherSuites: cbc}, false},
+	}
+
+	for i, test := range tests {
+		test.opts.AllowCIDRs = []string{"127.0.0.1/32"}
+		test.opts.Resolver = newFakeResolver(map[string][]string{"secure.example": {"127.0.0.1"}})
+		tr, err := NewTransport(test.opts)
+		if err != nil {
+			t.Fatalf("%d: unexpected error creating transport: %s", i, err.Error())
+		}
+		tr.TLSClientConfig.RootCAs = roots
+		client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+		resp, err := client.Get("https://secure.example:" + test.port + "/")
+		if test.refused {
+			if err == nil {
+				resp.Body.Close()
+				t.Fatalf("%d: expected the connection to be refused", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %s", i, err.Error())
+		}
+		resp.Body.Close()
+	}
+
+	// Unknown versions, and insecure suites, are rejected.
+	if _, err := NewTransport(Options{MinTLSVersion: 0x0200}); err == nil {
+		t.Fatalf("expected error with an unknown version")
+	}
+	if _, err := NewTransport(Options{CipherSuites: []uint16{tls.TLS_RSA_WITH_RC4_128_SHA}}); err == nil {
+		t.Fatalf("expected error with an insecure suite")
+	}
+}
@@ -0,0 +1,127 @@
+package remotehttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+)
+
+// Tracer creates spans for the fetches made by our transport, if it is
+// set in our Options.
+//
+// It is modelled upon the OpenTelemetry tracing API, so that a Tracer
+// from go.opentelemetry.io/otel may be adapted in a few lines, without
+// this package depending upon it.
+type Tracer interface {
+
+	// Start creates a span with the given name, returning it along
+	// with a context containing it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single fetch which is being traced, see Tracer.
+type Span interface {
+
+	// SetAttribute records the given attribute of the fetch.
+	SetAttribute(key string, value interface{})
+
+	// RecordError records that the fetch failed.
+	RecordError(err error)
+
+	// End completes the span.
+	End()
+}
+
+// The attributes recorded for each fetch.
+const (
+	// AttributeHost is the hostname which was requested.
+	AttributeHost = "server.address"
+
+	// AttributePort is the port which was requested.
+	AttributePort = "server.port"
+
+	// AttributeMethod is the method of the request.
+	AttributeMethod = "http.request.method"
+
+	// AttributeIP is the address which was connected to.
+	AttributeIP = "network.peer.address"
+
+	// AttributeStatus is the status code of the response.
+	AttributeStatus = "http.response.status_code"
+
+	// AttributeBlocked records whether the fetch was denied.
+	AttributeBlocked = "remotehttp.blocked"
+)
+
+// SpanName is the name of the span created for each fetch.
+const SpanName = "remotehttp.fetch"
+
+// fetchSpan records the state of a fetch which is being traced.
+type fetchSpan struct {
+
+	// Protects blocked.
+	mutex sync.Mutex
+
+	// Was the fetch denied?
+	blocked bool
+}
+
+// block records that the fetch was denied.
+func (f *fetchSpan) block() {
+	f.mutex.Lock()
+	f.blocked = true
+	f.mutex.Unlock()
+}
+
+// isBlocked returns whether the fetch was denied.
+func (f *fetchSpan) isBlocked() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.blocked
+}
+
+// fetchSpanFromContext returns the fetchSpan stored in the given context,
+// if any.
+func fetchSpanFromContext(ctx context.Context) *fetchSpan {
+	span, _ := ctx.Value(fetchSpanKey).(*fetchSpan)
+	return span
+}
+
+// traceRoundTrip makes the given request, within a span created by our
+// Tracer.
+//
+// The span ends once the response headers have been received, or the
+// request fails.
+func (t *SafeTransport) traceRoundTrip(req *http.Request) (*http.Response, error) {
+
+	ctx, span := t.options.Tracer.Start(req.Context(), SpanName)
+	defer span.End()
+
+	port, _ := strconv.Atoi(t.urlPort(req.URL))
+	span.SetAttribute(AttributeHost, req.URL.Hostname())
+	span.SetAttribute(AttributePort, port)
+	span.SetAttribute(AttributeMethod, req.Method)
+
+	// Record the address we connect to, and any denial.
+	state := &fetchSpan{}
+	ctx = context.WithValue(ctx, fetchSpanKey, state)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				span.SetAttribute(AttributeIP, addr.IP.String())
+			}
+		},
+	})
+
+	resp, err := t.RoundTrip(req.WithContext(ctx))
+	span.SetAttribute(AttributeBlocked, state.isBlocked())
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttribute(AttributeStatus, resp.StatusCode)
+	return resp, nil
+}
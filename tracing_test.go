@@ -0,0 +1,120 @@
+package remotehttp
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSpan records the attributes of a span.
+type fakeSpan struct {
+	mutex      sync.Mutex
+	name       string
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *fakeSpan) RecordError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.err = err
+}
+
+func (s *fakeSpan) End() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ended = true
+}
+
+// fakeTracer records the spans it creates.
+type fakeTracer struct {
+	mutex sync.Mutex
+	spans []*fakeSpan
+}
+
+func (f *fakeTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	span := &fakeSpan{name: name, attributes: make(map[string]interface{})}
+	f.spans = append(f.spans, span)
+	return ctx, span
+}
+
+// Test that a span is created for each fetch.
+func TestTracer(t *testing.T) {
+
+	srv, port := testServer(t, okHandler)
+	defer srv.Close()
+
+	tracer := &fakeTracer{}
+	tr, err := NewTransport(Options{
+		AllowCIDRs: []string{"127.0.0.1/32"},
+		Tracer:     tracer,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %s", err.Error())
+	}
+	client := &http.Client{Transport: tr, Timeout: 5 * time.Second}
+
+	// A permitted fetch.
+	resp, err := client.Get("http://127.0.0.1:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	// A denied fetch.
+	_, err = client.Get("http://127.0.0.2:" + port + "/")
+	if err == nil {
+		t.Fatalf("expected error fetching a local address")
+	}
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("expected two spans, got %d", len(tracer.spans))
+	}
+
+	tests := []struct {
+		span     *fakeSpan
+		expected map[string]interface{}
+		failed   bool
+	}{
+		{tracer.spans[0], map[string]interface{}{
+			AttributeHost:    "127.0.0.1",
+			AttributeMethod:  "GET",
+			AttributeIP:      "127.0.0.1",
+			AttributeStatus:  http.StatusOK,
+			AttributeBlocked: false,
+		}, false},
+		{tracer.spans[1], map[string]interface{}{
+			AttributeHost:    "127.0.0.2",
+			AttributeMethod:  "GET",
+			AttributeBlocked: true,
+		}, true},
+	}
+
+	for i, test := range tests {
+		if test.span.name != SpanName || !test.span.ended {
+			t.Fatalf("span %d: unexpected name %s, or not ended", i, test.span.name)
+		}
+		for key, value := range test.expected {
+			if test.span.attributes[key] != value {
+				t.Fatalf("span %d: expected %s to be %v, got %v", i, key, value, test.span.attributes[key])
+			}
+		}
+		if test.failed != (test.span.err != nil) {
+			t.Fatalf("span %d: unexpected error %v", i, test.span.err)
+		}
+		if _, ok := test.span.attributes[AttributeStatus]; ok && test.failed {
+			t.Fatalf("span %d: unexpected status for a failed fetch", i)
+		}
+	}
+}
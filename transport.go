@@ -0,0 +1,1263 @@
+package remotehttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SafeTransport is a http.Transport which will refuse to connect to
+// local resources, created via NewTransport.
+//
+// The embedded http.Transport may be modified as you wish, however the
+// `DialContext` function should not be changed, or our protection is
+// removed.  Where possible prefer to configure the transport via Options,
+// and make any changes before the transport is first used.
+type SafeTransport struct {
+
+	// The wrapped transport.
+	*http.Transport
+
+	// The options we were created with.
+	options Options
+
+	// The dialler we use to make outgoing connections.
+	dialler *net.Dialer
+
+	// The function we use to make outgoing connections, which
+	// is the dialler's DialContext unless we're testing.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// The network ranges which are explicitly allowed.
+	allow []*net.IPNet
+
+	// The network ranges which are denied, in addition to the
+	// built-in ones.
+	deny []*net.IPNet
+
+	// The ranges of addresses which are denied, in addition to the
+	// built-in ones.
+	denyRanges []*ipRange
+
+	// The built-in ranges which are no longer denied.
+	exclude map[string]bool
+
+	// The metadata endpoints which are always denied, if any.
+	metadata []net.IP
+
+	// The addresses of our own interfaces, if they're denied.
+	own *ownAddresses
+
+	// The (normalized) hostnames which are allowed.
+	allowHosts []string
+
+	// The (normalized) hostname patterns which are allowed.
+	allowPatterns []string
+
+	// The (normalized) host:port combinations which are allowed.
+	allowHostPorts map[string]bool
+
+	// The (normalized) hostname patterns which are denied.
+	denyHosts []string
+
+	// The (normalized) top-level domains which are denied.
+	denyTLDs []string
+
+	// The ports which are denied.
+	deniedPorts map[int]bool
+
+	// The (normalized) PTR suffixes which are denied.
+	ptrSuffixes []string
+
+	// The ASNs which are denied.
+	deniedASNs map[uint32]bool
+
+	// The addresses to use for specific (normalized) hosts.
+	overrides map[string]net.IP
+
+	// The resolver we use to lookup hostnames.
+	resolver Resolver
+
+	// The cache of pinned hosts, if enabled.
+	pins *pinCache
+
+	// The cache of denied hosts, if enabled.
+	denials *denyCache
+
+	// The limit upon our open connections, if any.
+	totalConns *ConnLimiter
+
+	// The connections we've made, so that we may shutdown.
+	conns *connTracker
+}
+
+// NewTransport creates a new SafeTransport, configured with the given
+// options.
+//
+// An error will be returned if the options are invalid.
+func NewTransport(opts Options) (*SafeTransport, error) {
+
+	// The local address must be a TCP address, if set, as we
+	// only ever make TCP connections.
+	if opts.LocalAddr != nil {
+		if _, ok := opts.LocalAddr.(*net.TCPAddr); !ok {
+			return nil, fmt.Errorf("local address %s is not a TCP address", opts.LocalAddr)
+		}
+	}
+
+	// Add the entries from our environment, if we should.
+	if opts.UseEnvAllowlist {
+		opts.AllowCIDRs = append([]string{}, opts.AllowCIDRs...)
+		opts.AllowHosts = append([]string{}, opts.AllowHosts...)
+
+		for _, entry := range strings.Split(os.Getenv("REMOTEHTTP_ALLOW"), ",") {
+			entry = strings.TrimSpace(entry)
+
+			switch {
+			case entry == "":
+				continue
+			case strings.Contains(entry, "/"):
+				opts.AllowCIDRs = append(opts.AllowCIDRs, entry)
+			case net.ParseIP(entry) != nil:
+				if strings.Contains(entry, ":") {
+					opts.AllowCIDRs = append(opts.AllowCIDRs, entry+"/128")
+				} else {
+					opts.AllowCIDRs = append(opts.AllowCIDRs, entry+"/32")
+				}
+			default:
+				opts.AllowHosts = append(opts.AllowHosts, entry)
+			}
+		}
+	}
+
+	// Parse the ranges we're going to allow.
+	var allow []*net.IPNet
+	for _, entry := range opts.AllowCIDRs {
+		_, block, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse allowed range %s: %s", entry, err)
+		}
+		allow = append(allow, block)
+	}
+
+	// Parse the extra ranges we're going to deny.
+	var deny []*net.IPNet
+	for _, entry := range opts.DenyCIDRs {
+		_, block, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse denied range %s: %s", entry, err)
+		}
+		deny = append(deny, block)
+	}
+
+	// Parse the ranges of addresses we're going to deny.
+	var denyRanges []*ipRange
+	for _, entry := range opts.DenyIPRanges {
+		r, err := _parseIPRange(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse denied range: %s", err)
+		}
+		denyRanges = append(denyRanges, r)
+	}
+
+	// Record the built-in ranges we're going to exclude.
+	exclude := make(map[string]bool)
+	for _, entry := range opts.ExcludeCIDRs {
+		found := false
+		for _, local := range append(localIP4, localIP6...) {
+			if local == entry {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("excluded range %s is not a built-in range", entry)
+		}
+		exclude[entry] = true
+	}
+
+	// Normalize the hostnames we're going to allow.
+	allowHosts, err := _normalizePatterns(opts.AllowHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse allowed host: %s", err)
+	}
+	for _, host := range allowHosts {
+		if strings.HasPrefix(host, "*.") {
+			return nil, fmt.Errorf("allowed host %s must not be a pattern", host)
+		}
+	}
+
+	// Normalize the host:port combinations we're going to allow.
+	allowHostPorts := make(map[string]bool)
+	for _, entry := range opts.AllowHostPorts {
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse allowed host and port %s: %s", entry, err)
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("allowed host and port %s has an invalid port", entry)
+		}
+		key, err := _hostPortKey(host, port)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("allowed host and port %s has an invalid host", entry)
+		}
+		allowHostPorts[key] = true
+	}
+
+	// Normalize the hostname patterns we're going to allow.
+	allowPatterns, err := _normalizePatterns(opts.AllowHostPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse allowed host pattern: %s", err)
+	}
+
+	// Normalize the hostnames we're going to deny.
+	denyHosts, err := _normalizePatterns(opts.DenyHostPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse denied host pattern: %s", err)
+	}
+
+	// Normalize the top-level domains we're going to deny.
+	tlds := opts.DenyTLDs
+	if opts.DenySpecialUseTLDs {
+		tlds = append(append([]string{}, tlds...), DefaultSpecialUseTLDs...)
+	}
+	var trimmed []string
+	for _, tld := range tlds {
+		trimmed = append(trimmed, strings.Trim(tld, "."))
+	}
+	denyTLDs, err := _normalizePatterns(trimmed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse denied TLD: %s", err)
+	}
+
+	// Record the ports we're going to deny.
+	deniedPorts := make(map[int]bool)
+	for _, port := range opts.DeniedPorts {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("denied port %d is invalid", port)
+		}
+		deniedPorts[port] = true
+	}
+
+	// Parse the metadata endpoints, if we're going to block them.
+	var metadata []net.IP
+	if opts.BlockMetadataEndpoints {
+		entries := opts.MetadataIPs
+		if len(entries) == 0 {
+			entries = DefaultMetadataIPs
+		}
+		for _, entry := range entries {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("failed to parse metadata address %s", entry)
+			}
+			metadata = append(metadata, ip)
+		}
+	}
+
+	// Read our own addresses, if we're going to deny them.
+	var own *ownAddresses
+	if opts.OwnAddressRefresh < 0 {
+		return nil, fmt.Errorf("own address refresh must not be negative")
+	}
+	if opts.DenyOwnAddresses {
+		refresh := opts.OwnAddressRefresh
+		if refresh == 0 {
+			refresh = time.Minute
+		}
+		own, err = newOwnAddresses(refresh)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// We can't restrict ourselves to both families.
+	if opts.IPv4Only && opts.IPv6Only {
+		return nil, fmt.Errorf("IPv4Only and IPv6Only are mutually exclusive")
+	}
+
+	// We can't deny both families.
+	if opts.DenyIPv4 && opts.DenyIPv6 {
+		return nil, fmt.Errorf("DenyIPv4 and DenyIPv6 are mutually exclusive")
+	}
+
+	// Our family preference must be known.
+	if opts.PreferredFamily < AnyFamily || opts.PreferredFamily > IPv6Family {
+		return nil, fmt.Errorf("unknown preferred family %d", opts.PreferredFamily)
+	}
+	if opts.IPSelection < AsReturned || opts.IPSelection > Stable {
+		return nil, fmt.Errorf("unknown address selection %d", opts.IPSelection)
+	}
+	if opts.FamilyFallbackDelay < 0 {
+		return nil, fmt.Errorf("family fallback delay must not be negative")
+	}
+
+	// The ports of our schemes must be valid.
+	for scheme, port := range opts.SchemePorts {
+		if strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https") {
+			return nil, fmt.Errorf("the port of scheme %s can't be changed", scheme)
+		}
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %d for scheme %s", port, scheme)
+		}
+	}
+
+	// Connection limits must be sane.
+	if opts.MaxConnsPerHost < 0 || opts.MaxIdleConnsPerHost < 0 || opts.MaxTotalConns < 0 {
+		return nil, fmt.Errorf("connection limits must not be negative")
+	}
+	if opts.IdleConnTimeout < 0 {
+		return nil, fmt.Errorf("idle connection timeout must not be negative")
+	}
+
+	// As must our throughput.
+	if opts.BytesPerSecond < 0 {
+		return nil, fmt.Errorf("bytes per second must not be negative")
+	}
+
+	// Timeouts must be sane.
+	if opts.ResolveTimeout < 0 || opts.DialTimeout < 0 || opts.RequestTimeout < 0 || opts.ConnectBudget < 0 {
+		return nil, fmt.Errorf("timeouts must not be negative")
+	}
+	dialTimeout := opts.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 30 * time.Second
+	}
+	headerTimeout := opts.ResponseHeaderTimeout
+	switch {
+	case headerTimeout == 0:
+		headerTimeout = 5 * time.Second
+	case headerTimeout < 0:
+		headerTimeout = 0
+	}
+
+	// As must our header limit.
+	if opts.MaxResponseHeaderBytes < 0 {
+		return nil, fmt.Errorf("response header limit must not be negative")
+	}
+	headerBytes := opts.MaxResponseHeaderBytes
+	if headerBytes == 0 {
+		headerBytes = 1 << 20
+	}
+
+	// Retries must be sane.
+	if opts.DialRetries < 0 || opts.DialRetryBackoff < 0 {
+		return nil, fmt.Errorf("dial retries and backoff must not be negative")
+	}
+
+	// Parse our overrides.
+	overrides := make(map[string]net.IP)
+	for host, entry := range opts.HostIPOverrides {
+		name, err := _normalizeHost(host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse overridden host: %s", err)
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("failed to parse override address %s for %s", entry, host)
+		}
+		overrides[name] = ip
+	}
+
+	// Setup our resolver.
+	var resolver Resolver = net.DefaultResolver
+	if opts.Resolver != nil {
+		resolver = opts.Resolver
+	}
+
+	// Normalize the PTR suffixes we're going to deny, and ensure we
+	// can perform reverse lookups.
+	var ptrSuffixes []string
+	for _, suffix := range opts.BlockByPTRSuffix {
+		suffix = strings.ToLower(strings.Trim(suffix, "."))
+		if suffix == "" {
+			return nil, fmt.Errorf("PTR suffixes must not be empty")
+		}
+		ptrSuffixes = append(ptrSuffixes, suffix)
+	}
+	if len(ptrSuffixes) > 0 {
+		if _, ok := resolver.(ReverseResolver); !ok {
+			return nil, fmt.Errorf("resolver does not support reverse lookups")
+		}
+	}
+
+	// Record the ASNs we're going to deny, and ensure we can look
+	// them up.
+	deniedASNs := make(map[uint32]bool)
+	for _, asn := range opts.DenyASNs {
+		deniedASNs[asn] = true
+	}
+	if len(deniedASNs) > 0 && opts.ASNResolver == nil {
+		return nil, fmt.Errorf("denied ASNs require an ASN resolver")
+	}
+
+	// Ensure our resolver validates answers, if we require it.
+	if opts.RequireDNSSEC {
+		if v, ok := resolver.(DNSSECResolver); !ok || !v.ValidatesDNSSEC() {
+			return nil, fmt.Errorf("resolver does not perform DNSSEC validation")
+		}
+	}
+
+	// Setup our pin-cache, if enabled.
+	var pins *pinCache
+	if opts.PinTTL < 0 {
+		return nil, fmt.Errorf("pin TTL must not be negative")
+	}
+	if opts.PinTTL > 0 {
+		size := opts.PinCacheSize
+		if size <= 0 {
+			size = 1000
+		}
+		pins = newPinCache(opts.PinTTL, size)
+	}
+
+	// Setup our deny-cache, if enabled.
+	var denials *denyCache
+	if opts.DenyCacheTTL < 0 {
+		return nil, fmt.Errorf("deny cache TTL must not be negative")
+	}
+	if opts.DenyCacheTTL > 0 {
+		size := opts.DenyCacheSize
+		if size <= 0 {
+			size = 1000
+		}
+		denials = newDenyCache(opts.DenyCacheTTL, size)
+	}
+
+	// Our TLS version, and cipher suites, must be known.
+	minTLS := opts.MinTLSVersion
+	if minTLS == 0 {
+		minTLS = tls.VersionTLS12
+	}
+	if minTLS < tls.VersionTLS10 || minTLS > tls.VersionTLS13 {
+		return nil, fmt.Errorf("unknown minimum TLS version %x", opts.MinTLSVersion)
+	}
+	for _, id := range opts.CipherSuites {
+		known := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.ID == id {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("cipher suite %s is insecure, or unknown", tls.CipherSuiteName(id))
+		}
+	}
+
+	// Normalize the TLS names we're going to reject.
+	var tlsSuffixes []string
+	if opts.RejectInternalTLSNames {
+		entries := opts.InternalTLSNameSuffixes
+		if len(entries) == 0 {
+			entries = DefaultInternalTLSNameSuffixes
+		}
+		for _, suffix := range entries {
+			suffix = strings.ToLower(strings.Trim(suffix, "."))
+			if suffix == "" {
+				return nil, fmt.Errorf("internal TLS name suffixes must not be empty")
+			}
+			tlsSuffixes = append(tlsSuffixes, suffix)
+		}
+	}
+
+	// Setup a timeout in our dialler; though the user could change this.
+	dialler := &net.Dialer{
+		DualStack: true,
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: opts.LocalAddr,
+		Control:   opts.Control,
+	}
+
+	t := &SafeTransport{
+		options:        opts,
+		dialler:        dialler,
+		dial:           dialler.DialContext,
+		allow:          allow,
+		deny:           deny,
+		denyRanges:     denyRanges,
+		exclude:        exclude,
+		metadata:       metadata,
+		own:            own,
+		allowHosts:     allowHosts,
+		allowPatterns:  allowPatterns,
+		allowHostPorts: allowHostPorts,
+		denyHosts:      denyHosts,
+		denyTLDs:       denyTLDs,
+		deniedPorts:    deniedPorts,
+		ptrSuffixes:    ptrSuffixes,
+		deniedASNs:     deniedASNs,
+		overrides:      overrides,
+		resolver:       resolver,
+		pins:           pins,
+		denials:        denials,
+		conns:          &connTracker{},
+	}
+
+	// Limit our connections, if we should.
+	if opts.MaxTotalConns > 0 {
+		t.totalConns = NewConnLimiter(opts.MaxTotalConns)
+	}
+
+	// Create a transport with the suitable handlers.
+	t.Transport = &http.Transport{
+
+		// Setup the dialler.
+		Dial: dialler.Dial,
+
+		// Setup the connection helper
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if opts.ConnectBudget > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, opts.ConnectBudget)
+				defer cancel()
+			}
+			return (_checker(ctx, t, network, addr))
+		},
+
+		// Setup a simple timeout
+		TLSHandshakeTimeout: 5 * time.Second,
+
+		// Setup our connection limits.
+		MaxConnsPerHost:     opts.MaxConnsPerHost,
+		MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:     opts.IdleConnTimeout,
+		DisableKeepAlives:   opts.DisableKeepAlives,
+
+		// Disable transparent decompression, if we should.
+		DisableCompression: opts.DisableCompression,
+
+		// Attempt HTTP/2, which would otherwise be disabled by our
+		// custom DialContext.  HTTP/2 connections are made via our
+		// DialContext too, so they receive the same protection.
+		ForceAttemptHTTP2: true,
+
+		// Setup a simple timeout
+		ResponseHeaderTimeout: headerTimeout,
+
+		// Limit the size of the headers we'll read.
+		MaxResponseHeaderBytes: headerBytes,
+	}
+
+	// Make TLS connections ourselves, if they're limited by our
+	// connection budget.
+	if opts.ConnectBudget > 0 {
+		t.Transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return _dialTLS(ctx, t, network, addr)
+		}
+	}
+
+	// Use our proxy, if any.
+	if opts.Proxy != nil {
+		scheme := strings.ToLower(opts.Proxy.Scheme)
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("proxy %s has scheme %s, which is not supported", opts.Proxy.Redacted(), opts.Proxy.Scheme)
+		}
+		if opts.Proxy.Hostname() == "" {
+			return nil, fmt.Errorf("proxy %s has no host", opts.Proxy.Redacted())
+		}
+		t.Transport.Proxy = http.ProxyURL(opts.Proxy)
+	}
+
+	// Setup our TLS versions and suites, and reject certificates
+	// naming internal hosts, if we should.
+	t.Transport.TLSClientConfig = &tls.Config{
+		MinVersion:   minTLS,
+		CipherSuites: opts.CipherSuites,
+	}
+	if len(tlsSuffixes) > 0 {
+		t.Transport.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return _checkTLSNames(cs, tlsSuffixes)
+		}
+	}
+
+	return t, nil
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+//
+// Requests are tested against our options before they're made, and then
+// passed to the wrapped transport.
+//
+// Note that responses using HTTP/0.9, which have no status line or
+// headers, are always rejected by http.Transport.
+func (t *SafeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	// Create a span for the request, if we're tracing.
+	if t.options.Tracer != nil && fetchSpanFromContext(req.Context()) == nil {
+		return t.traceRoundTrip(req)
+	}
+
+	// Are credentials present?
+	err := t.checkUserInfo(req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Is an upgrade requested?
+	if req.Header.Get("Upgrade") != "" && !t.options.AllowProtocolUpgrades {
+		return nil, fmt.Errorf("request to %s asks for a protocol upgrade, which is denied", req.URL.Redacted())
+	}
+
+	// Does the Host header name a host we may not connect to?
+	if t.options.ValidateHostHeader {
+		err = t.checkHostHeader(req)
+		if err != nil {
+			t.reportBlock(req.Context(), req.Host, t.urlPort(req.URL), "tcp", err)
+			return nil, err
+		}
+	}
+
+	// If we're using a proxy it connects to the target, rather than
+	// us, so we must check the target now.  Similarly if we've named
+	// policies, as we might re-use a connection which was checked
+	// against another.
+	if t.options.Proxy != nil || len(t.options.NamedPolicies) > 0 {
+		_, err = _validate(req.Context(), t, req.URL.Hostname(), t.urlPort(req.URL))
+		if err != nil {
+			t.reportBlock(req.Context(), req.URL.Hostname(), t.urlPort(req.URL), "tcp", err)
+			return nil, err
+		}
+	}
+
+	// Remove any proxy headers, without modifying the caller's request.
+	if t.options.StripProxyHeaders {
+		req = req.Clone(req.Context())
+		StripProxyHeaders(req.Header)
+	}
+
+	// Record this request, if we're tracing.
+	if trace := redirectTraceFromContext(req.Context()); trace != nil {
+		hop := trace.add(req.URL.Redacted())
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+					trace.setIP(hop, addr.IP)
+				}
+			},
+		}))
+	}
+
+	// Apply our request timeout, if any, which covers reading the
+	// body too.
+	timeout := t.options.RequestTimeout
+	if d, ok := requestTimeoutFromContext(req.Context()); ok {
+		timeout = d
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		resp, err := t.roundTrip(req.WithContext(ctx))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+
+	return t.roundTrip(req)
+}
+
+// roundTrip makes the given request via the wrapped transport, testing
+// the response against our options.
+func (t *SafeTransport) roundTrip(req *http.Request) (*http.Response, error) {
+
+	var resp *http.Response
+	var err error
+	if t.options.StrictContentLength {
+		resp, err = t.strictRoundTrip(req)
+	} else {
+		resp, err = t.Transport.RoundTrip(req)
+	}
+	if err != nil {
+		return nil, _withHost(req.URL.Hostname(), err)
+	}
+
+	// Did the server switch protocols anyway?
+	if resp.StatusCode == http.StatusSwitchingProtocols && !t.options.AllowProtocolUpgrades {
+		resp.Body.Close()
+		return nil, fmt.Errorf("response from %s switched protocols, which is denied", req.URL.Redacted())
+	}
+
+	return resp, nil
+}
+
+// _withHost adds the given host to the given error, unless it already
+// names it.
+//
+// As we connect to the addresses a host resolves to, the errors from the
+// http.Transport about the connection, such as resets, name only the
+// address, which is confusing.  The original error may still be found
+// via errors.Is and errors.As.
+func _withHost(host string, err error) error {
+	if host == "" || strings.Contains(err.Error(), host) {
+		return err
+	}
+	return fmt.Errorf("request to %s failed: %w", host, err)
+}
+
+// Dialer returns the dialler used to make outgoing connections, which is
+// configured via our options.
+//
+// This is intended for inspection; changes made to it affect only new
+// connections, and should be made before the transport is first used.
+// Our checks are made before the dialler is used, regardless.
+func (t *SafeTransport) Dialer() *net.Dialer {
+	return t.dialler
+}
+
+// Close releases the state held by the transport, closing any idle
+// connections and clearing its caches.
+//
+// This is useful when the configuration is reloaded, or between tests.
+// The transport may still be used afterwards.
+func (t *SafeTransport) Close() {
+
+	t.CloseIdleConnections()
+
+	if t.pins != nil {
+		t.pins.Clear()
+	}
+	if t.denials != nil {
+		t.denials.Clear()
+	}
+}
+
+// DeniedRange describes a network range which is denied.
+type DeniedRange struct {
+
+	// CIDR is the network range.
+	CIDR string
+
+	// Reason explains why the range is denied.
+	Reason string
+}
+
+// EffectiveDeniedRanges returns the network ranges which will be denied,
+// along with the reason each is denied.
+//
+// See EffectiveDeniedCIDRs for details; unlike it the ranges which were
+// denied via DenyIPRanges are returned too, in their "start-end" form.
+func (t *SafeTransport) EffectiveDeniedRanges() []DeniedRange {
+
+	var ranges []DeniedRange
+
+	// The built-in ranges we've not excluded.
+	for _, entry := range append(localIP4, localIP6...) {
+		if !t.exclude[entry] {
+			ranges = append(ranges, DeniedRange{CIDR: entry, Reason: localDetails[entry].reason})
+		}
+	}
+
+	// The extra ranges.
+	for _, block := range t.deny {
+		ranges = append(ranges, DeniedRange{CIDR: block.String(), Reason: "denied by DenyCIDRs"})
+	}
+	for _, r := range t.denyRanges {
+		ranges = append(ranges, DeniedRange{CIDR: r.String(), Reason: "denied by DenyIPRanges"})
+	}
+
+	return ranges
+}
+
+// EffectiveDeniedCIDRs returns the network ranges which will be denied.
+//
+// This is the built-in local ranges, without any which have been
+// excluded, along with any extra ranges which have been denied via
+// DenyCIDRs.  Note that addresses within these ranges may still be
+// permitted by the allowlist.
+func (t *SafeTransport) EffectiveDeniedCIDRs() []string {
+
+	var ranges []string
+	for _, block := range t.EffectiveDeniedRanges() {
+		if !strings.Contains(block.CIDR, "-") {
+			ranges = append(ranges, block.CIDR)
+		}
+	}
+	return ranges
+}
+
+// denyKey returns the key of the given (normalized) host and port in our
+// deny-cache.
+//
+// Denials may depend upon the port, via AllowHostPorts or a policy, and
+// may be made by a policy selected via WithPolicyName, so the port and
+// the name of that policy are included.
+func (t *SafeTransport) denyKey(ctx context.Context, host, port string) string {
+	key := net.JoinHostPort(host, port)
+	if name, ok := policyNameFromContext(ctx); ok {
+		return name + "/" + key
+	}
+	return key
+}
+
+// checkHost tests whether we're permitted to connect to the given
+// (normalized) hostname, before it is resolved.
+func (t *SafeTransport) checkHost(host string) error {
+
+	for _, pattern := range t.denyHosts {
+		if _matchHostPattern(host, pattern) {
+			return fmt.Errorf("host %s is denied by pattern %s", host, pattern)
+		}
+	}
+
+	for _, tld := range t.denyTLDs {
+		if host == tld || strings.HasSuffix(host, "."+tld) {
+			return fmt.Errorf("host %s is denied as it is within the TLD %s", host, tld)
+		}
+	}
+	return nil
+}
+
+// checkScheme tests whether the given URL's scheme is permitted.
+func (t *SafeTransport) checkScheme(u *url.URL) error {
+
+	schemes := t.options.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+
+	for _, scheme := range schemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return nil
+		}
+	}
+	return fmt.Errorf("url %s has scheme %s, which is denied", u.Redacted(), u.Scheme)
+}
+
+// checkHostHeader tests whether the Host header of the given request, if
+// it differs from the host of its URL, names a host we may connect to.
+func (t *SafeTransport) checkHostHeader(req *http.Request) error {
+
+	if req.Host == "" {
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = strings.Trim(req.Host, "[]"), t.urlPort(req.URL)
+	}
+
+	// The same host as our URL?  Then it is validated anyway.
+	a, _ := _normalizeHost(host)
+	b, _ := _normalizeHost(req.URL.Hostname())
+	if a != "" && a == b {
+		return nil
+	}
+
+	_, err = _validate(req.Context(), t, host, port)
+	if err != nil {
+		return fmt.Errorf("host header %s of request to %s denied: %w", req.Host, req.URL.Redacted(), err)
+	}
+	return nil
+}
+
+// checkUserInfo tests whether the given URL contains credentials, which
+// we don't permit.
+func (t *SafeTransport) checkUserInfo(u *url.URL) error {
+
+	if u.User != nil && !t.options.AllowUserInfo {
+		return fmt.Errorf("url %s contains userinfo, which is denied", u.Redacted())
+	}
+	return nil
+}
+
+// checkPort tests whether we're permitted to connect to the given port.
+//
+// An empty port, which is unknown, is permitted.
+func (t *SafeTransport) checkPort(port string) error {
+
+	if port == "" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", port)
+	}
+	if t.deniedPorts[n] {
+		return fmt.Errorf("port %d is denied", n)
+	}
+	return nil
+}
+
+// allowedHost tests whether the given (normalized) hostname is allowed,
+// such that the addresses it resolves to need not be checked.
+func (t *SafeTransport) allowedHost(host string) bool {
+
+	for _, entry := range t.allowHosts {
+		if host == entry {
+			return true
+		}
+	}
+	for _, pattern := range t.allowPatterns {
+		if _matchHostPattern(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHostPort tests whether the given host and port are allowed by
+// AllowHostPorts, such that neither the port, nor the addresses the host
+// resolves to, need be checked.
+func (t *SafeTransport) allowedHostPort(host, port string) bool {
+
+	if len(t.allowHostPorts) == 0 {
+		return false
+	}
+	key, err := _hostPortKey(host, port)
+	if err != nil {
+		return false
+	}
+	return t.allowHostPorts[key]
+}
+
+// _hostPortKey returns the given host and port in a form which may be
+// compared, with the host normalized and any IP address in its canonical
+// form.
+func _hostPortKey(host, port string) (string, error) {
+
+	host, err := _normalizeHost(host)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// allowedIP tests whether the given IP address is within our allowed
+// ranges, or is a loopback address which we're permitting for testing.
+func (t *SafeTransport) allowedIP(ip net.IP) bool {
+
+	if t.options.InsecureAllowLoopbackForTesting && ip.IsLoopback() {
+		return true
+	}
+
+	for _, block := range t.allow {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMetadata tests whether the given IP address is a cloud metadata
+// endpoint we should deny.
+func (t *SafeTransport) checkMetadata(ip net.IP) error {
+
+	for _, entry := range t.metadata {
+		if entry.Equal(ip) {
+			return fmt.Errorf("ip address %s is denied as a cloud metadata endpoint", ip)
+		}
+	}
+	return nil
+}
+
+// checkPTR tests whether the given IP address reverse-resolves to a name
+// with one of our denied suffixes.
+//
+// Failures to lookup the address are ignored, as many addresses have no
+// PTR records.
+func (t *SafeTransport) checkPTR(ctx context.Context, ip net.IP) error {
+
+	if len(t.ptrSuffixes) == 0 {
+		return nil
+	}
+
+	names, err := t.resolver.(ReverseResolver).LookupAddr(ctx, ip.String())
+	if err != nil {
+		return nil
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, suffix := range t.ptrSuffixes {
+			if name == suffix || strings.HasSuffix(name, "."+suffix) {
+				return fmt.Errorf("ip address %s is denied as it resolves to %s", ip, name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkASN tests whether the given IP address belongs to one of our
+// denied ASNs.
+//
+// Failures to lookup the ASN are treated as denials.
+func (t *SafeTransport) checkASN(ctx context.Context, ip net.IP) error {
+
+	if len(t.deniedASNs) == 0 {
+		return nil
+	}
+
+	asn, err := t.options.ASNResolver.LookupASN(ctx, ip)
+	if err != nil {
+		return fmt.Errorf("failed to lookup ASN of ip address %s: %s", ip, err)
+	}
+	if t.deniedASNs[asn] {
+		return fmt.Errorf("ip address %s is denied as it belongs to AS%d", ip, asn)
+	}
+	return nil
+}
+
+// checkFamily tests whether the given IP address belongs to a family we
+// deny, via DenyIPv4 or DenyIPv6.
+func (t *SafeTransport) checkFamily(ip net.IP) error {
+	v4 := ip.To4() != nil
+	if v4 && t.options.DenyIPv4 {
+		return fmt.Errorf("ip address %s is denied as IPv4 connections are disabled", ip)
+	}
+	if !v4 && t.options.DenyIPv6 {
+		return fmt.Errorf("ip address %s is denied as IPv6 connections are disabled", ip)
+	}
+	return nil
+}
+
+// checkOwn tests whether the given IP address belongs to this host, if
+// DenyOwnAddresses is set.
+func (t *SafeTransport) checkOwn(ip net.IP) error {
+	if t.own != nil && t.own.Contains(ip) {
+		return fmt.Errorf("ip address %s is denied as it belongs to this host", ip)
+	}
+	return nil
+}
+
+// checkIP tests whether we're permitted to connect to the given IP address.
+//
+// Metadata endpoints and our own addresses are always denied, if
+// configured, then addresses within the allowed ranges are permitted.
+// Finally we deny anything which isn't globally routable, if required, is
+// local, within our extra denied ranges, or denied by our IsDenied
+// predicate.
+func (t *SafeTransport) checkIP(ip net.IP) error {
+
+	// Metadata endpoints are denied, regardless of the allowlist.
+	if err := t.checkMetadata(ip); err != nil {
+		return err
+	}
+
+	// As are our own addresses.
+	if err := t.checkOwn(ip); err != nil {
+		return err
+	}
+
+	// Explicitly allowed?
+	if t.allowedIP(ip) {
+		return nil
+	}
+
+	// Must the address be globally routable?
+	if t.options.RequireGlobalUnicast && !_isGlobalUnicast(ip) {
+		return fmt.Errorf("ip address %s is denied as it isn't globally routable", ip)
+	}
+
+	// Extra ranges are denied.
+	for _, block := range t.deny {
+		if block.Contains(ip) {
+			return fmt.Errorf("ip address %s is denied by range %s", ip, block)
+		}
+	}
+	for _, r := range t.denyRanges {
+		if r.Contains(ip) {
+			return fmt.Errorf("ip address %s is denied by range %s", ip, r)
+		}
+	}
+
+	// Otherwise deny local addresses, unless excluded.
+	if err := _localError(ip, t.exclude); err != nil {
+		return err
+	}
+
+	// Finally does our predicate deny it?
+	if t.options.IsDenied != nil {
+		if denied, reason := t.options.IsDenied(ip); denied {
+			return &LocalAddressError{IP: ip, Category: "custom", Reason: reason}
+		}
+	}
+
+	return nil
+}
+
+// policy returns the policy to consult for the given context, which is
+// the one selected via WithPolicyName, if any, or our default.
+func (t *SafeTransport) policy(ctx context.Context) Policy {
+	if name, ok := policyNameFromContext(ctx); ok {
+		if policy, ok := t.options.NamedPolicies[name]; ok {
+			return policy
+		}
+	}
+	return t.options.Policy
+}
+
+// checkAddress tests whether we're permitted to connect to the given IP
+// address, which the given (normalized) host resolved to.
+//
+// Addresses of a family we deny are always rejected.  If the host is
+// allowed we only need to check the address isn't a metadata endpoint,
+// or one of our own addresses.  If we only permit our allowlist then
+// other hosts must resolve to allowed ranges.  Finally our policy is
+// consulted.
+func (t *SafeTransport) checkAddress(ctx context.Context, host string, ip net.IP, port string) error {
+
+	// Is the family denied?
+	if err := t.checkFamily(ip); err != nil {
+		return err
+	}
+
+	var err error
+	if t.allowedHost(host) || t.allowedHostPort(host, port) || t.allowedHostPort(ip.String(), port) {
+		err = t.checkMetadata(ip)
+		if err == nil {
+			err = t.checkOwn(ip)
+		}
+	} else if t.options.AllowlistOnly && !t.allowedIP(ip) {
+		err = fmt.Errorf("host %s is not allowed, and ip address %s is not in an allowed range", host, ip)
+	} else {
+		err = t.checkIP(ip)
+		if err == nil {
+			err = t.checkPTR(ctx, ip)
+		}
+		if err == nil {
+			err = t.checkASN(ctx, ip)
+		}
+	}
+
+	// Does our policy permit it?
+	if policy := t.policy(ctx); err == nil && policy != nil {
+		n, _ := strconv.Atoi(port)
+		err = policy.Allow(ctx, host, ip, n)
+	}
+
+	// Record the host in our denial, so that it may be audited.
+	var local *LocalAddressError
+	if errors.As(err, &local) && local.Host == "" {
+		local.Host = host
+	}
+	return err
+}
+
+// _checkTLSNames tests whether the certificate presented by a server names
+// a host with one of the given (normalized) suffixes.
+func _checkTLSNames(cs tls.ConnectionState, suffixes []string) error {
+
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := cs.PeerCertificates[0]
+
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(name, "*."), "."))
+		if name == "" {
+			continue
+		}
+		for _, suffix := range suffixes {
+			if name == suffix || strings.HasSuffix(name, "."+suffix) {
+				return fmt.Errorf("tls certificate for %s names internal host %s", cs.ServerName, name)
+			}
+		}
+	}
+	return nil
+}
+
+// reportBlock reports the given denial to our OnBlock hook, if any, and
+// records it in the span of the request, if we're tracing.
+//
+// Failures to resolve the host are not denials, so are ignored.
+func (t *SafeTransport) reportBlock(ctx context.Context, host, port, network string, err error) {
+
+	var re *resolveError
+	if errors.As(err, &re) {
+		return
+	}
+
+	if span := fetchSpanFromContext(ctx); span != nil {
+		span.block()
+	}
+
+	if t.options.OnBlock == nil {
+		return
+	}
+
+	n, _ := strconv.Atoi(port)
+	info := ConnInfo{Host: host, Port: n, Network: network, Metadata: blockMetadataFromContext(ctx)}
+
+	var local *LocalAddressError
+	if errors.As(err, &local) {
+		info.IP = local.IP
+		if local.Host != "" {
+			info.Host = local.Host
+		}
+	}
+
+	t.options.OnBlock(info, err)
+}
+
+// dialRetry connects to the given (validated) address, retrying any
+// transient failures as configured.
+func (t *SafeTransport) dialRetry(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	backoff := t.options.DialRetryBackoff
+	if backoff == 0 {
+		backoff = 100 * time.Millisecond
+	}
+
+	attempt := 0
+	for {
+		con, err := t.dial(ctx, network, addr)
+		if err == nil {
+			return con, nil
+		}
+
+		// Give up if we've run out of retries, or the error
+		// isn't one which is worth retrying.
+		if attempt >= t.options.DialRetries || !_isTransient(err) {
+			return nil, err
+		}
+		attempt++
+
+		// Wait before retrying, unless we're cancelled.
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// lookupIP resolves the given host, applying our resolution timeout.
+func (t *SafeTransport) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+
+	if t.options.ResolveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.options.ResolveTimeout)
+		defer cancel()
+	}
+
+	// Only lookup the family we may connect to.  IP addresses are
+	// resolved as they are, so that they're denied by checkFamily,
+	// rather than failing to resolve.
+	network := "ip"
+	if net.ParseIP(host) == nil {
+		if t.options.DenyIPv4 {
+			network = "ip6"
+		}
+		if t.options.DenyIPv6 {
+			network = "ip4"
+		}
+	}
+	return t.resolver.LookupIP(ctx, network, host)
+}
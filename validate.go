@@ -0,0 +1,312 @@
+package remotehttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IsSafeURL tests whether the given URL may be fetched, using the options
+// set via SetDefaultOptions.
+//
+// See SafeTransport.IsSafeURL for details.
+func IsSafeURL(ctx context.Context, rawurl string) error {
+	return getDefaultTransport().IsSafeURL(ctx, rawurl)
+}
+
+// IsSafeURL tests whether the given URL may be fetched via this transport.
+//
+// The URL is parsed, and its scheme tested, then the host is resolved and
+// validated in the same way as when a connection is made.  This allows
+// user-supplied URLs to be rejected before any attempt is made to fetch
+// them.
+//
+// Note that a URL which is safe now might not be safe when it is later
+// fetched, as DNS might change; this is not a replacement for using our
+// transport.
+func (t *SafeTransport) IsSafeURL(ctx context.Context, rawurl string) error {
+	_, _, err := t.validateURL(ctx, rawurl)
+	return err
+}
+
+// validateURL parses and validates the given URL, returning it and the
+// destination it refers to.
+func (t *SafeTransport) validateURL(ctx context.Context, rawurl string) (*url.URL, *destination, error) {
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = t.checkScheme(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = t.checkUserInfo(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return nil, nil, fmt.Errorf("url %s has no host", u.Redacted())
+	}
+
+	dest, err := _validate(ctx, t, host, t.urlPort(u))
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, dest, nil
+}
+
+// URLReport describes why a URL was found to be safe, see InspectURL.
+type URLReport struct {
+
+	// URL is the URL which was inspected, without any credentials.
+	URL string
+
+	// Scheme is the URL's (lower-case) scheme.
+	Scheme string
+
+	// Host is the (normalized) hostname.
+	Host string
+
+	// Port is the port which would be connected to, which is the
+	// default for the scheme if the URL doesn't specify one.
+	Port int
+
+	// IPs contains the permitted addresses the host resolved to, in
+	// the order they'd be tried.
+	IPs []net.IP
+
+	// Pinned is true if the address was taken from our pin-cache,
+	// rather than resolved.
+	Pinned bool
+
+	// Checks contains the names of the checks which were passed, such
+	// as "scheme", "port" or "policy".
+	Checks []string
+
+	// Target is the address which would be connected to first.
+	Target string
+}
+
+// InspectURL tests whether the given URL may be fetched, as IsSafeURL does,
+// using the options set via SetDefaultOptions.
+//
+// See SafeTransport.InspectURL for details.
+func InspectURL(ctx context.Context, rawurl string) (*URLReport, error) {
+	return getDefaultTransport().InspectURL(ctx, rawurl)
+}
+
+// InspectURL tests whether the given URL may be fetched via this transport,
+// as IsSafeURL does, returning a report describing the decision if it may.
+//
+// Nothing is fetched.  The report is intended for auditing, and as with
+// IsSafeURL it describes the situation now, which might differ when the
+// URL is later fetched.
+func (t *SafeTransport) InspectURL(ctx context.Context, rawurl string) (*URLReport, error) {
+
+	u, dest, err := t.validateURL(ctx, rawurl)
+	if err != nil {
+		return nil, err
+	}
+	port := t.urlPort(u)
+
+	report := &URLReport{
+		URL:    u.Redacted(),
+		Scheme: strings.ToLower(u.Scheme),
+		Host:   dest.host,
+		Pinned: dest.pinned,
+		Checks: []string{"scheme", "userinfo", "host", "port", "address"},
+	}
+	report.Port, _ = strconv.Atoi(port)
+
+	if len(t.ptrSuffixes) > 0 {
+		report.Checks = append(report.Checks, "ptr")
+	}
+	if len(t.deniedASNs) > 0 {
+		report.Checks = append(report.Checks, "asn")
+	}
+	if t.policy(ctx) != nil {
+		report.Checks = append(report.Checks, "policy")
+	}
+
+	primary, fallback := t.dialOrder(dest.ips)
+	report.IPs = append(primary, fallback...)
+	if len(report.IPs) > 0 {
+		report.Target = net.JoinHostPort(report.IPs[0].String(), port)
+	}
+	return report, nil
+}
+
+// ValidateURLs tests whether each of the given URLs may be fetched, using
+// the options set via SetDefaultOptions.
+//
+// See SafeTransport.ValidateURLs for details.
+func ValidateURLs(ctx context.Context, urls []string, concurrency int) map[string]error {
+	return getDefaultTransport().ValidateURLs(ctx, urls, concurrency)
+}
+
+// ValidateURLs tests whether each of the given URLs may be fetched via
+// this transport, as IsSafeURL does.
+//
+// At most `concurrency` URLs are validated at once, or one if it is less
+// than one.  The result contains an entry for each URL, which is nil if
+// it is safe.  If the context is cancelled then any URLs which haven't
+// been validated are given the context's error.
+func (t *SafeTransport) ValidateURLs(ctx context.Context, urls []string, concurrency int) map[string]error {
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make(map[string]error, len(urls))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	// Our workers take URLs from this channel.
+	work := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range work {
+				err := ctx.Err()
+				if err == nil {
+					err = t.IsSafeURL(ctx, u)
+				}
+				mutex.Lock()
+				results[u] = err
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, u := range urls {
+		work <- u
+	}
+	close(work)
+	wg.Wait()
+
+	return results
+}
+
+// urlPort returns the port the given URL will be fetched from, which is
+// the default for its scheme if none is specified.
+//
+// This ensures that our port checks are applied to URLs such as
+// `http://example.com/`, just as they are when the connection is made.
+func (t *SafeTransport) urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	switch scheme {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	for name, port := range t.options.SchemePorts {
+		if strings.ToLower(name) == scheme {
+			return strconv.Itoa(port)
+		}
+	}
+	return ""
+}
+
+// FilterLocalIPs partitions the given addresses into those which are
+// permitted, and those which are blocked, by the options set via
+// SetDefaultOptions.
+//
+// See SafeTransport.FilterLocalIPs for details.
+func FilterLocalIPs(ips []net.IP) (safe []net.IP, blocked []net.IP) {
+	return getDefaultTransport().FilterLocalIPs(ips)
+}
+
+// FilterLocalIPs partitions the given addresses into those which are
+// permitted, and those which are blocked, by this transport.
+//
+// This is useful for callers which resolve hosts themselves.  Each address
+// is checked in the same way as a resolved address, against our ranges
+// and metadata endpoints; IPv4-mapped IPv6 addresses are treated as IPv4.
+// Checks which need a hostname, or further lookups, such as AllowHosts,
+// PTR and ASN checks, and Policy, are not applied.
+func (t *SafeTransport) FilterLocalIPs(ips []net.IP) (safe []net.IP, blocked []net.IP) {
+
+	for _, ip := range ips {
+		if t.checkIP(ip) == nil {
+			safe = append(safe, ip)
+		} else {
+			blocked = append(blocked, ip)
+		}
+	}
+	return safe, blocked
+}
+
+// ValidateURLMiddleware returns a http.Handler which validates a URL
+// supplied in each request, before passing it to the next handler.
+//
+// The URL is found via the given extractURL function, for example from a
+// form parameter, and tested via IsSafeURL.  If it is not safe then the
+// request is rejected with a "400 Bad Request" status.
+//
+// This allows user-supplied URLs to be validated with the same rules that
+// will be used when they're fetched.
+//
+// Only the URL returned by extractURL is validated; headers such as
+// X-Forwarded-Host, which may be set by the client, are ignored.  The
+// extractURL function should therefore not construct its result from
+// such headers.
+func ValidateURLMiddleware(next http.Handler, extractURL func(*http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		err := IsSafeURL(r.Context(), extractURL(r))
+		if err != nil {
+			http.Error(w, "the supplied URL is not permitted", http.StatusBadRequest)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// proxyHeaders are the headers, set by proxies and load balancers, which
+// are removed by StripProxyHeaders.
+//
+// Headers with the prefix "X-Forwarded-" are removed too.
+var proxyHeaders = []string{
+	"Forwarded",
+	"Via",
+	"X-Real-Ip",
+	"X-Client-Ip",
+	"True-Client-Ip",
+	"X-Original-Url",
+}
+
+// StripProxyHeaders removes the headers which describe how a request was
+// proxied, such as X-Forwarded-For, from the given headers.
+//
+// This is useful when the headers of an incoming request are copied to
+// an outgoing one, as they might leak details of your internal network
+// to the fetched host.  SafeTransport does this for each request if the
+// StripProxyHeaders option is set.
+func StripProxyHeaders(h http.Header) {
+
+	for _, name := range proxyHeaders {
+		h.Del(name)
+	}
+	for name := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "X-Forwarded-") {
+			delete(h, name)
+		}
+	}
+}